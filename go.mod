@@ -5,5 +5,6 @@ go 1.18
 require (
 	github.com/gomarkdown/markdown v0.0.0-20220607163217-45f7c050e2d1
 	github.com/google/uuid v1.3.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.13
 )
@@ -0,0 +1,370 @@
+// The admin API: inspecting clients and their mutexes, force-releasing
+// stuck mutexes, suspending clients, purging idle resources and backing up
+// and exporting server state. Every request must carry the admin credential
+// (see isAdmin).
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "encoding/json"
+    "mutex/server/persist"
+)
+
+// A suspended client's keys are rejected until it is resumed.
+type ClientSuspension struct {
+    Email string `db-pk:"true"`
+    Suspended int64
+}
+
+type AdminClientInfo struct {
+    Email string `json:"email"`
+    Plan string `json:"plan,omitempty"`
+    Suspended bool `json:"suspended"`
+    HeldMutexes int `json:"heldMutexes"`
+    Waiters int `json:"waiters"`
+}
+
+type AdminMutexInfo struct {
+    Identifier string `json:"identifier"`
+    Locked bool `json:"locked"`
+    Token uint64 `json:"token,omitempty"`
+    HolderRequestID string `json:"holderRequestId,omitempty"`
+    // unix time in milliseconds
+    Acquired int64 `json:"acquired,omitempty"`
+    Waiters int `json:"waiters"`
+}
+
+type HttpForceRelease struct {
+    StatusCode int `json:"statusCode"`
+    Token uint64 `json:"token"`
+}
+
+type HttpPurge struct {
+    StatusCode int `json:"statusCode"`
+    Evicted EvictionResult `json:"evicted"`
+}
+
+var ErrClientNotFound = errors.New("client not found")
+var ErrMutexNotHeld = errors.New("mutex not held")
+
+func findSuspension(email string) bool {
+    suspension := ClientSuspension{
+        Email: email,
+    }
+
+    return email != "" && persist.Find(&suspension) == nil
+}
+
+// Report whether an account has been suspended.
+func ClientSuspended(account string) bool {
+    cr := getClientResources(account)
+
+    cr.mu.RLock()
+    defer cr.mu.RUnlock()
+
+    return cr.suspended
+}
+
+func SuspendClient(email string) error {
+    if _, err := FindClient(email); err != nil {
+        return fmt.Errorf("%w: '%s'", ErrClientNotFound, email)
+    }
+
+    if !findSuspension(email) {
+        if err := persist.Insert(&ClientSuspension{
+            Email: email,
+            Suspended: time.Now().Unix(),
+        }); err != nil {
+            return err
+        }
+    }
+
+    cr := lockClientResources(email)
+    cr.suspended = true
+    cr.mu.Unlock()
+
+    return nil
+}
+
+func ResumeClient(email string) error {
+    if _, err := FindClient(email); err != nil {
+        return fmt.Errorf("%w: '%s'", ErrClientNotFound, email)
+    }
+
+    if err := persist.Delete(&ClientSuspension{
+        Email: email,
+    }); err != nil {
+        return err
+    }
+
+    cr := lockClientResources(email)
+    cr.suspended = false
+    cr.mu.Unlock()
+
+    return nil
+}
+
+// List every registered client along with the state of its (private)
+// resources.
+func ListClients() []AdminClientInfo {
+    clients := []AdminClientInfo{}
+
+    clientInfos := []ClientInfo{}
+    persist.FindAll(&ClientInfo{}, &clientInfos)
+
+    for _, clientInfo := range clientInfos {
+        clients = append(clients, AdminClientInfo{
+            Email: clientInfo.Email,
+            Plan: clientInfo.Plan,
+        })
+    }
+
+    for i := range clients {
+        clients[i].Suspended = findSuspension(clients[i].Email)
+
+        crmMutex.RLock()
+        cr, ok := clientResourceMap[clients[i].Email]
+        crmMutex.RUnlock()
+
+        if ok {
+            cr.mu.RLock()
+            clients[i].HeldMutexes = cr.heldMutexes
+            for _, state := range cr.semaphoreMap {
+                clients[i].Waiters += state.waiters
+            }
+            cr.mu.RUnlock()
+        }
+    }
+
+    return clients
+}
+
+// List the mutexes in an account's or namespace's resources.
+func ListMutexes(resources string) []AdminMutexInfo {
+    mutexes := []AdminMutexInfo{}
+
+    crmMutex.RLock()
+    cr, ok := clientResourceMap[resources]
+    crmMutex.RUnlock()
+
+    if !ok {
+        return mutexes
+    }
+
+    cr.mu.RLock()
+    for identifier, state := range cr.semaphoreMap {
+        mutexInfo := AdminMutexInfo{
+            Identifier: identifier,
+            Locked: state.holder != 0,
+            Token: state.holder,
+            HolderRequestID: state.holderRequestID,
+            Waiters: state.waiters,
+        }
+        if state.holder != 0 {
+            mutexInfo.Acquired = state.acquired.UnixMilli()
+        }
+
+        mutexes = append(mutexes, mutexInfo)
+    }
+    cr.mu.RUnlock()
+
+    sort.Slice(mutexes, func (i, j int) bool {
+        return mutexes[i].Identifier < mutexes[j].Identifier
+    })
+
+    return mutexes
+}
+
+// Release a mutex regardless of who holds it, waking the next waiter. The
+// released lock's token is no longer accepted by unlock. Returns the
+// released token.
+func ForceRelease(resources string, mutexIdentifier string) (uint64, error) {
+    crmMutex.RLock()
+    cr, ok := clientResourceMap[resources]
+    crmMutex.RUnlock()
+
+    if !ok {
+        return 0, fmt.Errorf("%w: '%s'", ErrMutexNotHeld, mutexIdentifier)
+    }
+
+    cr.mu.Lock()
+    defer cr.mu.Unlock()
+
+    state, ok := cr.semaphoreMap[mutexIdentifier]
+    if !ok || state.holder == 0 {
+        return 0, fmt.Errorf("%w: '%s'", ErrMutexNotHeld, mutexIdentifier)
+    }
+
+    holder := state.holder
+    if !cr.release(state, "forced") {
+        return 0, fmt.Errorf("%w: '%s'", ErrMutexNotHeld, mutexIdentifier)
+    }
+
+    return holder, nil
+}
+
+// The resources named by an admin request's client or namespace parameter.
+func adminResources(w http.ResponseWriter, req *http.Request) (string, bool) {
+    args := req.URL.Query()
+
+    switch {
+    case args.Get("namespace") != "":
+        return namespaceResources(args.Get("namespace")), true
+    case args.Get("client") != "":
+        return args.Get("client"), true
+    default:
+        reportError(w, req, 400, "specify client={email} or namespace={namespace}")
+
+        return "", false
+    }
+}
+
+// Route an admin request:
+//
+//  GET  /api/admin/clients
+//  POST /api/admin/clients/{email}?suspend|resume
+//  POST /api/admin/clients/{email}?plan={name}
+//  GET  /api/admin/plans
+//  POST /api/admin/plans/{name}
+//  GET  /api/admin/mutexes?client={email}|namespace={namespace}
+//  POST /api/admin/mutexes/{mutexIdentifier}?release&client={email}|namespace={namespace}
+//  GET  /api/admin/dashboard
+//  POST /api/admin/purge
+//  GET  /api/admin/backup
+//  GET  /api/admin/export
+//  POST /api/admin/import
+func adminHandler(w http.ResponseWriter, req *http.Request) {
+    if !isAdmin(req) {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="mutex.us admin"`)
+        reportError(w, req, 401, "admin credential required")
+
+        return
+    }
+
+    pathParams := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/api/admin/"), "/", 2)
+    resource, identifier := pathParams[0], ""
+    if len(pathParams) > 1 {
+        identifier = pathParams[1]
+    }
+    args := req.URL.Query()
+
+    switch {
+    case resource == "clients" && identifier == "" && req.Method == "GET":
+        WriteJSON(w, req, ListClients())
+    case resource == "clients" && identifier != "" && req.Method == "POST" &&
+            (args.Has("suspend") || args.Has("resume")):
+        var err error
+        action := AuditSuspend
+        if args.Has("suspend") {
+            err = SuspendClient(identifier)
+        } else {
+            action = AuditResume
+            err = ResumeClient(identifier)
+        }
+        recordRequestAudit(req, adminClient, identifier, action, identifier, 0, err)
+
+        if err != nil {
+            if errors.Is(err, ErrClientNotFound) {
+                reportError(w, req, 404, err.Error())
+            } else {
+                reportError(w, req, 500, err.Error())
+            }
+
+            return
+        }
+
+        WriteJSON(w, req, &HttpSuccess{
+            StatusCode: 200,
+        })
+    case resource == "clients" && identifier != "" && req.Method == "POST" && args.Has("plan"):
+        if err := AssignPlan(identifier, args.Get("plan")); err != nil {
+            if errors.Is(err, ErrClientNotFound) || errors.Is(err, ErrPlanNotFound) {
+                reportError(w, req, 404, err.Error())
+            } else {
+                reportError(w, req, 500, err.Error())
+            }
+
+            return
+        }
+
+        WriteJSON(w, req, &HttpSuccess{
+            StatusCode: 200,
+        })
+    case resource == "plans" && identifier == "" && req.Method == "GET":
+        plans, err := ListPlans()
+        if err != nil {
+            reportError(w, req, 500, err.Error())
+
+            return
+        }
+
+        WriteJSON(w, req, plans)
+    case resource == "plans" && identifier != "" && req.Method == "POST":
+        plan := &Plan{}
+        if err := json.NewDecoder(req.Body).Decode(plan); err != nil {
+            reportError(w, req, 400, fmt.Sprintf("invalid plan: %s", err))
+
+            return
+        }
+        plan.Name = identifier
+
+        if err := SavePlan(plan); err != nil {
+            if errors.Is(err, ErrInvalidPlan) {
+                reportError(w, req, 400, err.Error())
+            } else {
+                reportError(w, req, 500, err.Error())
+            }
+
+            return
+        }
+
+        WriteJSON(w, req, plan)
+    case resource == "mutexes" && identifier == "" && req.Method == "GET":
+        resources, ok := adminResources(w, req)
+        if !ok {
+            return
+        }
+
+        WriteJSON(w, req, ListMutexes(resources))
+    case resource == "mutexes" && identifier != "" && req.Method == "POST" && args.Has("release"):
+        resources, ok := adminResources(w, req)
+        if !ok {
+            return
+        }
+
+        holder, err := ForceRelease(resources, identifier)
+        recordRequestAudit(req, adminClient, resources, AuditForceRelease, identifier, holder, err)
+        if err != nil {
+            reportError(w, req, 409, err.Error())
+
+            return
+        }
+
+        WriteJSON(w, req, &HttpForceRelease{
+            StatusCode: 200,
+            Token: holder,
+        })
+    case resource == "dashboard" && identifier == "" && req.Method == "GET":
+        WriteJSON(w, req, dashboardState("", true))
+    case resource == "purge" && identifier == "" && req.Method == "POST":
+        // evict everything that isn't in use now
+        WriteJSON(w, req, &HttpPurge{
+            StatusCode: 200,
+            Evicted: EvictIdle(0),
+        })
+    case resource == "backup" && identifier == "" && req.Method == "GET":
+        backupHandler(w, req)
+    case resource == "export" && identifier == "" && req.Method == "GET":
+        exportHandler(w, req)
+    case resource == "import" && identifier == "" && req.Method == "POST":
+        importHandler(w, req)
+    default:
+        reportError(w, req, 400, "bad request")
+    }
+}
@@ -2,195 +2,722 @@ package main
 
 import (
     "fmt"
-    "log"
+    "net"
     "sync"
-    "database/sql"
+    "context"
+    "strings"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/mail"
     "time"
     "errors"
     "sync/atomic"
 
     "github.com/google/uuid"
+    "mutex/server/mailer"
+    "mutex/server/logging"
     "mutex/server/persist"
+    "mutex/server/ratelimit"
     "mutex/server/semaphore"
+    "mutex/server/tracing"
 )
 
 type ClientInfo struct {
     Email string `json:"email" db-pk:"true"`
+    // the registration key, returned to the client but never stored
     ClientID string `json:"clientID"`
+    Plan string `json:"plan,omitempty"`
 }
 
 type ClientResources struct {
     mu sync.RWMutex
-    totalLocks *int32
-    previousTotalLocks int32
-    totalUnlocks *int32
-    previousTotalUnlocks int32
-    semaphoreMap map[string]*semaphore.Semaphore
+    semaphoreMap map[string]*mutexState
+    mutexStats map[string]*mutexStats
+    rateLimiterMap map[string]*rateLimiterState
+    plan *Plan
+    requestLimiter *ratelimit.TokenBucket
+    heldMutexes int
+    lockGeneration uint64
+    suspended bool
+    // set when the resources are evicted from clientResourceMap, after
+    // which they must not be used (see lockClientResources)
+    evicted bool
+    lastUsed time.Time
 }
 
+// Bookkeeping for a single mutex, protected by the owning
+// ClientResources.mu.
+type mutexState struct {
+    semaphore *semaphore.Semaphore
+    waiters int
+    // generation of the current lock, zero if the mutex isn't held
+    holder uint64
+    // request ID of the lock request that acquired the mutex
+    holderRequestID string
+    acquired time.Time
+    leaseTimer *time.Timer
+    // zero if the lock has no lease
+    leaseExpires time.Time
+    // traces the time the mutex is held, from acquisition to release
+    holdSpan *tracing.Span
+    // shared with ClientResources.mutexStats
+    stats *mutexStats
+    lastUsed time.Time
+}
+
+// A rate limiter and the number of requests currently taking from it,
+// protected by the owning ClientResources.mu.
+type rateLimiterState struct {
+    bucket *ratelimit.TokenBucket
+    takers int
+    lastUsed time.Time
+}
+
+var ErrDuplicateClient = errors.New("duplicate client")
+var ErrStaleToken = errors.New("stale lock token")
+var ErrTokenRequired = errors.New("lock token required")
+
 var crmMutex sync.RWMutex
 var clientResourceMap = map[string]*ClientResources{}
-var purgeClientChannel chan string
+
+// operation totals for /stats, which outlive evicted resources
+var totalLocks, totalUnlocks, totalTakes int64
 
 func init() {
     uuid.EnableRandPool()
 
     clientResourceMap = make(map[string]*ClientResources)
-    purgeClientChannel = make(chan string)
-
-    go PurgeClientWorker()
-    go PurgeClientDaemon()
 }
 
-func getClientResources(clientID string) (cr *ClientResources) {
+// Resources are partitioned by account (the client's registered email) so
+// that all of an account's API keys share the same mutexes, and by shared
+// namespace (see ResolveNamespace). A namespace's limits are those of its
+// owner's plan.
+func getClientResources(account string) (cr *ClientResources) {
     crmMutex.RLock()
-    cr, ok := clientResourceMap[clientID]
+    cr, ok := clientResourceMap[account]
     crmMutex.RUnlock()
 
     if ok {
         return cr
     }
 
+    plan := DefaultPlan()
+    if owner, err := resourcesAccount(account); err == nil {
+        if clientInfo, err := FindClient(owner); err == nil {
+            plan = LoadPlan(clientInfo.Plan)
+        }
+    }
+    suspended := !strings.HasPrefix(account, namespaceResourcePrefix) && findSuspension(account)
+
     crmMutex.Lock()
     defer crmMutex.Unlock()
 
+    if cr, ok = clientResourceMap[account]; ok {
+        return cr
+    }
+
     cr = &ClientResources{
-        totalLocks: new(int32),
-        totalUnlocks: new(int32),
-        semaphoreMap: make(map[string]*semaphore.Semaphore),
+        semaphoreMap: make(map[string]*mutexState),
+        mutexStats: make(map[string]*mutexStats),
+        rateLimiterMap: make(map[string]*rateLimiterState),
+        plan: plan,
+        requestLimiter: plan.newRequestLimiter(),
+        // seeded from the clock so that lock tokens aren't reused if the
+        // resources are purged and recreated or the server restarts
+        lockGeneration: uint64(time.Now().UnixMicro()),
+        suspended: suspended,
+        lastUsed: time.Now(),
     }
 
-    clientResourceMap[clientID] = cr
+    clientResourceMap[account] = cr
 
     return cr
 }
 
-func RegisterClient(email string) (*ClientInfo, error) {
-    clientInfo := &ClientInfo{
+// A registration waiting for its email address to be confirmed. The
+// client's key is issued at registration but only activated, by inserting
+// its KeyRecord, once the verification token mailed to the client is
+// presented.
+type PendingRegistration struct {
+    TokenHash string `db-pk:"true"`
+    Email string
+    KeyHash string
+    KeyPrefix string
+    KeySalt string
+    Created int64
+}
+
+var siteMailer mailer.Mailer
+
+// Registrations send email, so they're throttled per remote address and per
+// email address, keyed "addr:{host}" and "email:{address}".
+var registrationMutex sync.Mutex
+var registrationLimiters = map[string]*ratelimit.TokenBucket{}
+
+var ErrInvalidEmail = errors.New("invalid email address")
+var ErrInvalidToken = errors.New("invalid or expired verification token")
+
+func ValidateEmail(email string) error {
+    address, err := mail.ParseAddress(email)
+    if err != nil || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+        return fmt.Errorf("%w: '%s'", ErrInvalidEmail, email)
+    }
+
+    return nil
+}
+
+func hashToken(token string) string {
+    hash := sha256.Sum256([]byte(token))
+
+    return hex.EncodeToString(hash[:])
+}
+
+// Count a registration against the limits of its remote address and email
+// address. Returns how long to wait before retrying if either is exceeded.
+func CheckRegistrationRate(remoteAddr string, email string) (time.Duration, error) {
+    if *RegistrationsPerHour <= 0 {
+        return 0, nil
+    }
+
+    host, _, err := net.SplitHostPort(remoteAddr)
+    if err != nil {
+        host = remoteAddr
+    }
+
+    for _, key := range []string{"addr:" + host, "email:" + strings.ToLower(email)} {
+        registrationMutex.Lock()
+        limiter, ok := registrationLimiters[key]
+        if !ok {
+            limiter = ratelimit.NewTokenBucket(float64(*RegistrationsPerHour) / 3600.0, *RegistrationsPerHour)
+            registrationLimiters[key] = limiter
+        }
+        registrationMutex.Unlock()
+
+        if err := limiter.Take(1, 0, nil); err != nil {
+            return limiter.RetryAfter(1), fmt.Errorf("%w: too many registrations", ErrQuotaExceeded)
+        }
+    }
+
+    return 0, nil
+}
+
+// Forget registration limiters that have refilled, and delete registrations
+// that can no longer be confirmed.
+func sweepRegistrations(now time.Time) {
+    registrationMutex.Lock()
+    for key, limiter := range registrationLimiters {
+        if limiter.Full() {
+            delete(registrationLimiters, key)
+        }
+    }
+    registrationMutex.Unlock()
+
+    pendings := []PendingRegistration{}
+    if err := persist.FindAll(&PendingRegistration{}, &pendings); err != nil {
+        logger.Error("unable to sweep pending registrations", "error", err)
+
+        return
+    }
+
+    for _, pending := range pendings {
+        if now.Sub(time.Unix(pending.Created, 0)) > VerificationTTL {
+            if err := persist.Delete(&pending); err != nil {
+                logger.Error("unable to delete pending registration", "error", err)
+            }
+        }
+    }
+}
+
+// Register a new client. With -requireEmailVerification the client's key
+// isn't usable until ConfirmRegistration is called with the token emailed
+// to verifyURL; pending is true in that case.
+func RegisterClient(email string, verifyURL string) (clientInfo *ClientInfo, pending bool, err error) {
+    if err = ValidateEmail(email); err != nil {
+        return nil, false, err
+    }
+
+    if _, err = FindClient(email); err == nil {
+        return nil, false, fmt.Errorf("%w: email '%s' is already in use", ErrDuplicateClient, email)
+    }
+
+    clientInfo = &ClientInfo{
         ClientID: uuid.New().String(),
         Email: email,
     }
 
-    err := persist.Insert(clientInfo)
+    apiKey := &ApiKey{
+        Key: clientInfo.ClientID,
+        Email: email,
+        Name: primaryKeyName,
+        Created: time.Now().Unix(),
+    }
+
+    if !*RequireEmailVerification {
+        return clientInfo, false, activateClient(apiKey)
+    }
+
+    keyRecord, err := newKeyRecord(apiKey)
     if err != nil {
-        return nil, err
+        return nil, false, err
+    }
+
+    token := uuid.New().String()
+    if err = persist.Insert(&PendingRegistration{
+        TokenHash: hashToken(token),
+        Email: email,
+        KeyHash: keyRecord.Hash,
+        KeyPrefix: keyRecord.Prefix,
+        KeySalt: keyRecord.Salt,
+        Created: apiKey.Created,
+    }); err != nil {
+        return nil, false, err
+    }
+
+    body := fmt.Sprintf("Someone (hopefully you) registered this email address with mutex.us.\n\n" +
+            "To activate your API key, confirm your address within %v by visiting:\n\n%s?verify&token=%s\n\n" +
+            "If you didn't register, ignore this message and the key will never be activated.\n",
+            VerificationTTL, verifyURL, token)
+
+    if err = siteMailer.Send(email, "Confirm your mutex.us registration", body); err != nil {
+        return nil, false, err
+    }
+
+    return clientInfo, true, nil
+}
+
+func insertClient(ctx context.Context, tx persist.Records, email string) error {
+    if err := tx.Insert(ctx, &ClientInfo{
+        Email: email,
+    }); err != nil {
+        if errors.Is(err, persist.ErrDuplicate) {
+            return fmt.Errorf("%w: email '%s' is already in use", ErrDuplicateClient, email)
+        }
+
+        return err
+    }
+
+    return nil
+}
+
+// Create the client's account and activate its first key.
+func activateClient(apiKey *ApiKey) error {
+    ctx := context.Background()
+    if err := persist.WithTx(ctx, func (tx persist.Records) error {
+        if err := insertClient(ctx, tx, apiKey.Email); err != nil {
+            return err
+        }
+
+        return insertApiKey(ctx, tx, apiKey, nil)
+    }); err != nil {
+        return err
     }
 
     // instantiate the map now to avoid another DB lookup later
-    _ = getClientResources(clientInfo.ClientID)
+    _ = getClientResources(apiKey.Email)
 
-    return clientInfo, err
+    return nil
 }
 
-func VerifyClient(clientID string) bool {
-    crmMutex.RLock()
-    _, ok := clientResourceMap[clientID]
-    crmMutex.RUnlock()
+// Confirm a pending registration, activating the key issued with it. The
+// first registration of an address to be confirmed wins.
+func ConfirmRegistration(token string) (string, error) {
+    pending := PendingRegistration{
+        TokenHash: hashToken(token),
+    }
+    err := persist.Find(&pending)
 
-    if ok {
-        return true
+    if err != nil ||
+            time.Since(time.Unix(pending.Created, 0)) > VerificationTTL {
+        return "", ErrInvalidToken
     }
 
-    var clientInfoFound ClientInfo
-    persist.Find(&ClientInfo{
-        ClientID: clientID,
-    }, func (rows *sql.Rows) {
-        rows.Scan(&clientInfoFound.Email, &clientInfoFound.ClientID)
-    })
+    ctx := context.Background()
+    if err = persist.WithTx(ctx, func (tx persist.Records) error {
+        if err := insertClient(ctx, tx, pending.Email); err != nil {
+            return err
+        }
 
-    if clientInfoFound.ClientID != clientID {
-        return false
+        if err := tx.Delete(ctx, &pending); err != nil {
+            return err
+        }
+
+        return tx.Insert(ctx, &KeyRecord{
+            Hash: pending.KeyHash,
+            Prefix: pending.KeyPrefix,
+            Salt: pending.KeySalt,
+            Email: pending.Email,
+            Name: primaryKeyName,
+            Created: pending.Created,
+        })
+    }); err != nil {
+        return "", err
     }
 
-    _ = getClientResources(clientID)
+    return pending.Email, nil
+}
 
-    return true
+// Look up a registered client by email.
+func FindClient(email string) (*ClientInfo, error) {
+    // an empty email would match any client
+    if email == "" {
+        return nil, persist.ErrNotFound
+    }
+
+    clientInfoFound := ClientInfo{
+        Email: email,
+    }
+
+    if err := persist.Find(&clientInfoFound); err != nil {
+        return nil, err
+    }
+
+    return &clientInfoFound, nil
 }
 
-func GetMaxWaitTimeout(clientID string) time.Duration {
-    // !!!TBD!!! wsm -- this is where clients could have "premium"
-    // accounts with longer timeouts
-    return time.Duration(3) * time.Minute
+func GetMaxWaitTimeout(account string) time.Duration {
+    return GetClientPlan(account).MaxWait()
 }
 
-func LockSemaphore(clientID string, mutexIdentifier string, waitTimeoutMs time.Duration,
-            done <-chan struct{}) error {
-    cr := getClientResources(clientID)
+// Clamp a requested lease duration to the client's plan. A non-positive
+// request asks for the longest lease the plan allows (zero meaning the
+// mutex is held until it is unlocked).
+func GetLeaseDuration(account string, requested time.Duration) time.Duration {
+    maxLease := GetClientPlan(account).MaxLease()
 
-    cr.mu.Lock()
-    semaphoreInstance, ok := cr.semaphoreMap[mutexIdentifier]
+    if requested <= 0 || (maxLease > 0 && requested > maxLease) {
+        return maxLease
+    }
+
+    return requested
+}
+
+// Lock a mutex, waiting up to waitTimeoutMs for it or until ctx is done.
+// Returns the lock's token (generation).
+func LockSemaphore(ctx context.Context, account string, mutexIdentifier string, waitTimeoutMs time.Duration,
+            lease time.Duration) (uint64, error) {
+    if Draining() {
+        return 0, ErrDraining
+    }
+
+    cr := lockClientResources(account)
+    reqLogger := requestLogger(ctx).With("mutex", mutexIdentifier)
+
+    state, ok := cr.semaphoreMap[mutexIdentifier]
 
     if !ok {
-        semaphoreInstance = semaphore.NewSemaphore(1)
-        cr.semaphoreMap[mutexIdentifier] = semaphoreInstance
+        state = &mutexState{
+            semaphore: semaphore.NewSemaphore(1),
+            stats: cr.stats(mutexIdentifier),
+        }
+        cr.semaphoreMap[mutexIdentifier] = state
+    }
+
+    plan := cr.plan
+    if plan.MaxWaiters > 0 && state.holder != 0 && state.waiters >= plan.MaxWaiters {
+        waiters := state.waiters
+        cr.mu.Unlock()
+        return 0, fmt.Errorf("%w: mutex '%s' already has %d waiters", ErrQuotaExceeded,
+                mutexIdentifier, waiters)
+    }
+
+    if plan.MaxMutexes > 0 && cr.heldMutexes >= plan.MaxMutexes {
+        heldMutexes := cr.heldMutexes
+        cr.mu.Unlock()
+        return 0, fmt.Errorf("%w: client already holds %d mutexes", ErrQuotaExceeded,
+                heldMutexes)
+    }
+
+    state.waiters++
+    queued := state.waiters - 1
+    state.lastUsed = time.Now()
+    stats := state.stats
+    if state.holder != 0 {
+        stats.contended++
+    }
+    if state.waiters > stats.maxQueueDepth {
+        stats.maxQueueDepth = state.waiters
     }
     cr.mu.Unlock()
 
-    if err := semaphoreInstance.Lock(waitTimeoutMs, done); err != nil {
-        return err
+    _, waitSpan := tracer.Start(ctx, "mutex wait", tracing.KindInternal)
+    waitSpan.SetAttribute("mutex.id", mutexIdentifier)
+    waitSpan.SetAttribute("mutex.waiters", queued)
+
+    waitStart := time.Now()
+    done, stopWaiting := waitDone(ctx)
+    err := drainError(ctx, state.semaphore.Lock(waitTimeoutMs, done))
+    stopWaiting()
+    lockWaitSeconds.Observe(time.Since(waitStart).Seconds())
+
+    waitSpan.SetError(err)
+    waitSpan.End()
+
+    cr.mu.Lock()
+    defer cr.mu.Unlock()
+
+    state.waiters--
+    stats.waits.add(time.Since(waitStart))
+
+    if err != nil {
+        if errors.Is(err, semaphore.ErrTimeout) {
+            stats.timeouts++
+            lockTimeouts.Inc()
+        } else if errors.Is(err, semaphore.ErrDisconnected) {
+            lockDisconnects.Inc()
+        }
+
+        reqLogger.Info("lock failed", "error", err, "holder_request_id", state.holderRequestID,
+                "wait_ms", time.Since(waitStart).Milliseconds())
+
+        return 0, err
     }
 
-    atomic.AddInt32(cr.totalLocks, 1)
+    // other mutexes may have been acquired while this request waited
+    if plan.MaxMutexes > 0 && cr.heldMutexes >= plan.MaxMutexes {
+        state.semaphore.Unlock()
 
-    return nil
+        return 0, fmt.Errorf("%w: client already holds %d mutexes", ErrQuotaExceeded,
+                cr.heldMutexes)
+    }
+
+    cr.lockGeneration++
+    generation := cr.lockGeneration
+    state.holder = generation
+    state.holderRequestID = requestID(ctx)
+    state.acquired = time.Now()
+    _, state.holdSpan = tracer.Start(ctx, "mutex hold", tracing.KindInternal)
+    state.holdSpan.SetAttribute("mutex.id", mutexIdentifier)
+    cr.heldMutexes++
+    stats.acquires++
+    lockAcquisitions.Inc()
+
+    if lease > 0 {
+        cr.startLease(account, mutexIdentifier, state, lease, reqLogger)
+    }
+
+    reqLogger.Debug("lock acquired", "wait_ms", time.Since(waitStart).Milliseconds())
+
+    atomic.AddInt64(&totalLocks, 1)
+
+    return generation, nil
 }
 
-func UnlockSemaphore(clientID string, mutexIdentifier string) error {
-    cr := getClientResources(clientID)
+// Release the mutex's current lock when lease expires unless it has been
+// released by then. cr.mu must be held by the caller.
+func (cr *ClientResources) startLease(account string, mutexIdentifier string, state *mutexState,
+            lease time.Duration, reqLogger *logging.Logger) {
+    generation := state.holder
+    holderRequestID := state.holderRequestID
+    state.leaseExpires = time.Now().Add(lease)
+
+    var timer *time.Timer
+    timer = time.AfterFunc(lease, func () {
+        cr.mu.Lock()
+        // the lease may have been renewed while this waited for cr.mu
+        released := state.holder == generation && state.leaseTimer == timer &&
+                cr.release(state, "lease_expired")
+        cr.mu.Unlock()
+
+        if !released {
+            return
+        }
+
+        reqLogger.Warn("lease expired", "lease_ms", lease.Milliseconds())
+        RecordAudit(&AuditEvent{
+            Resources: account,
+            Action: AuditExpire,
+            Identifier: mutexIdentifier,
+            Holder: int64(generation),
+            RequestID: holderRequestID,
+        })
+    })
+    state.leaseTimer = timer
+}
+
+// Report whether a mutex is held and how many requests are waiting for it.
+func GetMutexStatus(account string, mutexIdentifier string) (locked bool, waiters int) {
+    cr := getClientResources(account)
     cr.mu.RLock()
     defer cr.mu.RUnlock()
 
-    if _, ok := cr.semaphoreMap[mutexIdentifier]; !ok {
-        return errors.New(fmt.Sprintf("invalid mutex identifier '%s'", mutexIdentifier))
+    if state, ok := cr.semaphoreMap[mutexIdentifier]; ok {
+        return state.holder != 0, state.waiters
     }
 
-    if !cr.semaphoreMap[mutexIdentifier].Unlock() {
-        return errors.New(fmt.Sprintf("unable to unlock mutex '%s' (mismatched lock/unlock calls?)",
-                mutexIdentifier))
+    return false, 0
+}
+
+// Release a held mutex, recording why for metrics. cr.mu must be held by
+// the caller.
+func (cr *ClientResources) release(state *mutexState, reason string) bool {
+    if state.holder == 0 || !state.semaphore.Unlock() {
+        return false
+    }
+
+    if state.leaseTimer != nil {
+        state.leaseTimer.Stop()
+        state.leaseTimer = nil
+        state.leaseExpires = time.Time{}
     }
 
-    atomic.AddInt32(cr.totalUnlocks, 1)
+    state.holdSpan.SetAttribute("mutex.release_reason", reason)
+    state.holdSpan.End()
+    state.holdSpan = nil
 
-    return nil
+    state.holder = 0
+    state.holderRequestID = ""
+    state.lastUsed = time.Now()
+    cr.heldMutexes--
+    lockHoldSeconds.Observe(time.Since(state.acquired).Seconds())
+    state.stats.holds.add(time.Since(state.acquired))
+    lockReleases.Inc(reason)
+
+    return true
 }
 
-func PurgeClientWorker() {
-    log.Println("PurgeClientWorker started")
-    for clientID := range purgeClientChannel {
-        log.Printf("PurgeClientWorker: purging client %s", clientID)
-        crmMutex.Lock()
-        delete(clientResourceMap, clientID)
-        crmMutex.Unlock()
+// Unlock a mutex, returning the token of the lock that was released. The
+// token must be the current lock's: the lock it identifies may have expired
+// or been force-released, and the mutex locked again. A zero token releases
+// whichever lock is current, and is only accepted with -tokenlessUnlock.
+func UnlockSemaphore(account string, mutexIdentifier string, token uint64) (uint64, error) {
+    if token == 0 && !*TokenlessUnlock {
+        return 0, fmt.Errorf("%w: pass the token returned by lock to unlock mutex '%s'",
+                ErrTokenRequired, mutexIdentifier)
     }
-    log.Println("PurgeClientWorker exiting")
+
+    cr := lockClientResources(account)
+    defer cr.mu.Unlock()
+
+    state, ok := cr.semaphoreMap[mutexIdentifier]
+    if !ok {
+        return 0, errors.New(fmt.Sprintf("invalid mutex identifier '%s'", mutexIdentifier))
+    }
+
+    holder := state.holder
+    if token != 0 && token != holder {
+        return 0, fmt.Errorf("%w: lock token %d for mutex '%s' is no longer valid (lease expired or force-released?)",
+                ErrStaleToken, token, mutexIdentifier)
+    }
+
+    if !cr.release(state, "unlock") {
+        return 0, errors.New(fmt.Sprintf("unable to unlock mutex '%s' (mismatched lock/unlock calls or lease expired?)",
+                mutexIdentifier))
+    }
+
+    atomic.AddInt64(&totalUnlocks, 1)
+
+    return holder, nil
 }
 
-func PurgeClientDaemon() {
-    log.Println("PurgeClientDaemon started")
-    for {
-        log.Printf("PurgeClientDaemon: sleeping %v", PurgeInterval)
-        time.Sleep(PurgeInterval)
-        log.Printf("PurgeClientDaemon: purging idle clients")
-        PurgeIdleClients()
+// Extend the lease of the lock identified by token to lease from now,
+// clamped to the client's plan as for LockSemaphore. Returns the lease
+// granted, zero if the mutex is now held until it is unlocked.
+func RenewLease(ctx context.Context, account string, mutexIdentifier string, token uint64,
+            lease time.Duration) (time.Duration, error) {
+    if token == 0 {
+        return 0, fmt.Errorf("%w: pass the token returned by lock to renew mutex '%s'",
+                ErrTokenRequired, mutexIdentifier)
+    }
+
+    lease = GetLeaseDuration(account, lease)
+
+    cr := lockClientResources(account)
+    defer cr.mu.Unlock()
+
+    state, ok := cr.semaphoreMap[mutexIdentifier]
+    if !ok || state.holder != token {
+        return 0, fmt.Errorf("%w: lock token %d for mutex '%s' is no longer valid (lease expired or force-released?)",
+                ErrStaleToken, token, mutexIdentifier)
+    }
+
+    if state.leaseTimer != nil {
+        state.leaseTimer.Stop()
+        state.leaseTimer = nil
+        state.leaseExpires = time.Time{}
+    }
+
+    if lease > 0 {
+        cr.startLease(account, mutexIdentifier, state, lease,
+                requestLogger(ctx).With("mutex", mutexIdentifier))
     }
+
+    return lease, nil
 }
 
-func PurgeIdleClients() {
-    crmMutex.RLock()
-    for clientID, cr := range clientResourceMap {
-        cr.mu.Lock()
-        if *cr.totalLocks == cr.previousTotalLocks && *cr.totalUnlocks == cr.previousTotalUnlocks {
-            if *cr.totalLocks != *cr.totalUnlocks {
-                log.Printf("PurgeIdleClients: client %s: mutex(s) held too long", clientID)
-            }
+// Take n tokens from the named rate limiter, creating it with the given
+// limits if it doesn't exist yet. A rate of zero leaves an existing
+// limiter's configuration alone. Returns the tokens remaining on success or
+// the estimated wait before a retry could succeed on failure (zero if a
+// retry can never succeed).
+func TakeTokens(ctx context.Context, account string, limiterIdentifier string, n int, rate float64, burst int,
+            waitTimeout time.Duration) (int, time.Duration, error) {
+    cr := lockClientResources(account)
+    limiter, ok := cr.rateLimiterMap[limiterIdentifier]
 
-            purgeClientChannel <- clientID
+    if !ok {
+        if rate <= 0 {
+            cr.mu.Unlock()
+            return 0, 0, errors.New(fmt.Sprintf("rate limiter '%s' does not exist (specify rate to create it)",
+                    limiterIdentifier))
         }
 
-        cr.previousTotalLocks = *cr.totalLocks
-        cr.previousTotalUnlocks = *cr.totalUnlocks
+        bucket := ratelimit.NewTokenBucket(rate, burst)
+        if bucket == nil {
+            cr.mu.Unlock()
+            return 0, 0, errors.New(fmt.Sprintf("invalid rate limiter configuration: rate %v burst %d",
+                    rate, burst))
+        }
+        limiter = &rateLimiterState{
+            bucket: bucket,
+        }
+        cr.rateLimiterMap[limiterIdentifier] = limiter
+    } else if rate > 0 && !limiter.bucket.SetLimits(rate, burst) {
+        cr.mu.Unlock()
+        return 0, 0, errors.New(fmt.Sprintf("invalid rate limiter configuration: rate %v burst %d",
+                rate, burst))
+    }
+    bucket := limiter.bucket
+    limiter.takers++
+    limiter.lastUsed = time.Now()
+    cr.mu.Unlock()
 
+    defer func () {
+        cr.mu.Lock()
+        limiter.takers--
+        limiter.lastUsed = time.Now()
         cr.mu.Unlock()
+    }()
+
+    _, waitSpan := tracer.Start(ctx, "ratelimit wait", tracing.KindInternal)
+    waitSpan.SetAttribute("ratelimit.id", limiterIdentifier)
+    waitSpan.SetAttribute("ratelimit.tokens", n)
+    defer waitSpan.End()
+
+    if err := bucket.Take(n, waitTimeout, ctx.Done()); err != nil {
+        waitSpan.SetError(err)
+        rateLimitTakes.Inc("limited")
+
+        if errors.Is(err, ratelimit.ErrBurstExceeded) {
+            return 0, 0, err
+        }
+
+        return 0, bucket.RetryAfter(n), err
     }
-    crmMutex.RUnlock()
+
+    atomic.AddInt64(&totalTakes, 1)
+    rateLimitTakes.Inc("ok")
+
+    return bucket.Available(), 0, nil
+}
+
+// cr.mu must be held by the caller.
+func (cr *ClientResources) hasWaiters() bool {
+    for _, state := range cr.semaphoreMap {
+        if state.waiters > 0 {
+            return true
+        }
+    }
+
+    return false
 }
@@ -0,0 +1,193 @@
+// A persistent, append-only audit log of lock and key operations.
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/google/uuid"
+    "mutex/server/persist"
+)
+
+// An AuditEvent records one operation. Events are only ever inserted.
+type AuditEvent struct {
+    ID string `json:"-" db-pk:"true"`
+    // unix time in milliseconds
+    Time int64 `json:"time"`
+    // the clientResourceMap key of the account or namespace the event
+    // concerns
+    Resources string `json:"-"`
+    // the account that performed the operation, empty for the server
+    Client string `json:"client,omitempty"`
+    Action string `json:"action"`
+    Identifier string `json:"identifier"`
+    // the token (lock generation) of the lock the event concerns
+    Holder int64 `json:"holder,omitempty"`
+    RequestID string `json:"requestId,omitempty"`
+    RemoteAddr string `json:"remoteAddr,omitempty"`
+    // "ok" or the reason the operation failed
+    Outcome string `json:"outcome"`
+}
+
+// Audited actions.
+const (
+    AuditLock = "lock"
+    AuditUnlock = "unlock"
+    AuditRenew = "renew"
+    AuditExpire = "expire"
+    AuditKeyCreate = "key_create"
+    AuditKeyRotate = "key_rotate"
+    AuditKeyRevoke = "key_revoke"
+    AuditForceRelease = "force_release"
+    AuditSuspend = "suspend"
+    AuditResume = "resume"
+)
+
+// The client recorded for operations performed through the admin API.
+const adminClient = "admin"
+
+const maxAuditEvents = 1000
+
+// Record an event, filling in its ID and time. Failing to record an event
+// doesn't fail the operation; it is logged instead.
+func RecordAudit(event *AuditEvent) {
+    // IDs sort in the order events were recorded, ordering events recorded
+    // in the same millisecond
+    now := time.Now()
+    event.ID = fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.New().String())
+    event.Time = now.UnixMilli()
+
+    if event.Outcome == "" {
+        event.Outcome = "ok"
+    }
+
+    if err := persist.Insert(event); err != nil {
+        logger.Error("unable to record audit event", "error", err, "action", event.Action,
+                "identifier", event.Identifier)
+    }
+}
+
+// Record an operation performed by an API request.
+func recordRequestAudit(req *http.Request, client string, resources string, action string,
+            identifier string, holder uint64, err error) {
+    event := &AuditEvent{
+        Resources: resources,
+        Client: client,
+        Action: action,
+        Identifier: identifier,
+        Holder: int64(holder),
+        RequestID: requestID(req.Context()),
+        RemoteAddr: req.RemoteAddr,
+    }
+
+    if err != nil {
+        event.Outcome = err.Error()
+    }
+
+    RecordAudit(event)
+}
+
+// Return the newest limit events at or after since (unix milliseconds),
+// newest first, for resources (every account and namespace if empty) and
+// optionally only one identifier.
+func FindAuditEvents(resources string, identifier string, since int64, limit int) ([]AuditEvent, error) {
+    events := []AuditEvent{}
+    err := persist.FindRange(&AuditEvent{
+        Resources: resources,
+        Identifier: identifier,
+    }, persist.Range{
+        Field: "Time",
+        From: since,
+        Descending: true,
+        Limit: limit,
+    }, &events)
+
+    return events, err
+}
+
+// Delete events older than -auditRetention.
+func sweepAuditEvents(now time.Time) {
+    if AuditRetention <= 0 {
+        return
+    }
+
+    deleted, err := persist.DeleteRange(&AuditEvent{}, persist.Range{
+        Field: "Time",
+        Before: now.Add(-AuditRetention).UnixMilli(),
+    })
+    if err != nil {
+        logger.Error("unable to sweep audit events", "error", err)
+    } else if deleted > 0 {
+        logger.Debug("deleted expired audit events", "count", deleted)
+    }
+}
+
+// Parse a since parameter given as an RFC 3339 time or unix milliseconds.
+func parseSince(since string) (int64, error) {
+    if since == "" {
+        return 0, nil
+    }
+
+    if t, err := time.Parse(time.RFC3339, since); err == nil {
+        return t.UnixMilli(), nil
+    }
+
+    if ms, err := strconv.ParseInt(since, 10, 64); err == nil {
+        return ms, nil
+    }
+
+    return 0, errors.New(fmt.Sprintf("invalid since '%s' (use an RFC 3339 time or unix milliseconds)", since))
+}
+
+func apiAuditHandler(w http.ResponseWriter, req *http.Request, apiKey string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+
+    if !checkRequestRate(w, req, credential.Account) {
+        return
+    }
+
+    args := req.URL.Query()
+    if !authorize(w, req, credential, OpAudit, args.Get("mutex")) {
+        return
+    }
+
+    resources, ok := resolveNamespace(w, req, credential)
+    if !ok {
+        return
+    }
+
+    if req.Method != "GET" {
+        reportError(w, req, 400, "use GET for audit log")
+
+        return
+    }
+
+    since, err := parseSince(args.Get("since"))
+    if err != nil {
+        reportError(w, req, 400, err.Error())
+
+        return
+    }
+
+    limit := maxAuditEvents
+    if args.Has("limit") {
+        if limitArg, err := strconv.Atoi(args.Get("limit")); err == nil && limitArg > 0 && limitArg < limit {
+            limit = limitArg
+        }
+    }
+
+    events, err := FindAuditEvents(resources, args.Get("mutex"), since, limit)
+    if err != nil {
+        reportError(w, req, 500, err.Error())
+
+        return
+    }
+
+    WriteJSON(w, req, events)
+}
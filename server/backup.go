@@ -0,0 +1,309 @@
+// Backup and migration of server state: online copies of the SQLite
+// database, and JSON exports of accounts, keys, quotas and held locks that
+// can be imported into a fresh instance using any store.
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "reflect"
+    "time"
+
+    "encoding/json"
+    "mutex/server/persist"
+)
+
+// The version of the export format, checked on import.
+const exportVersion = 1
+
+type Export struct {
+    Version int `json:"version"`
+    // unix time in milliseconds
+    Exported int64 `json:"exported"`
+    Clients []ClientInfo `json:"clients"`
+    Suspensions []ClientSuspension `json:"suspensions"`
+    Plans []Plan `json:"plans"`
+    Keys []KeyRecord `json:"keys"`
+    KeyScopes []KeyScope `json:"keyScopes"`
+    KeyRevocations []KeyRevocation `json:"keyRevocations"`
+    Namespaces []Namespace `json:"namespaces"`
+    NamespaceGrants []NamespaceGrant `json:"namespaceGrants"`
+    GrantRevocations []GrantRevocation `json:"grantRevocations"`
+    HeldLocks []HeldLock `json:"heldLocks"`
+}
+
+type HttpImport struct {
+    StatusCode int `json:"statusCode"`
+    Imported int `json:"imported"`
+    RestoredLocks int `json:"restoredLocks"`
+}
+
+var ErrNotFresh = errors.New("import requires an instance without clients")
+
+// A table of an export: a record of the table's type and a pointer to the
+// export's slice of them.
+type exportTable struct {
+    record interface{}
+    records interface{}
+}
+
+func (export *Export) tables() []exportTable {
+    return []exportTable{
+        {&ClientInfo{}, &export.Clients},
+        {&ClientSuspension{}, &export.Suspensions},
+        {&Plan{}, &export.Plans},
+        {&KeyRecord{}, &export.Keys},
+        {&KeyScope{}, &export.KeyScopes},
+        {&KeyRevocation{}, &export.KeyRevocations},
+        {&Namespace{}, &export.Namespaces},
+        {&NamespaceGrant{}, &export.NamespaceGrants},
+        {&GrantRevocation{}, &export.GrantRevocations},
+        {&HeldLock{}, &export.HeldLocks},
+    }
+}
+
+// Export the stored state along with the locks held now. Held locks saved
+// at shutdown are exported too, so a stopped server's database can be
+// exported.
+func ExportState() (*Export, error) {
+    export := &Export{
+        Version: exportVersion,
+        Exported: time.Now().UnixMilli(),
+    }
+
+    for _, table := range export.tables() {
+        // export empty tables as [] rather than null
+        records := reflect.ValueOf(table.records).Elem()
+        records.Set(reflect.MakeSlice(records.Type(), 0, 0))
+
+        if err := persist.FindAll(table.record, table.records); err != nil {
+            return nil, err
+        }
+    }
+
+    for _, heldLock := range currentHeldLocks() {
+        export.HeldLocks = append(export.HeldLocks, *heldLock)
+    }
+
+    return export, nil
+}
+
+// Import an export in one transaction, returning the number of records
+// imported. Plans replace any of the same name; everything else must be
+// new, so the instance must have no clients. Held locks are saved to be
+// reacquired by RestoreHeldLocks.
+func ImportState(export *Export) (int, error) {
+    if export.Version != exportVersion {
+        return 0, errors.New(fmt.Sprintf("unsupported export version %d (expected %d)",
+                export.Version, exportVersion))
+    }
+
+    imported := 0
+    ctx := context.Background()
+    err := persist.WithTx(ctx, func (tx persist.Records) error {
+        clients := []ClientInfo{}
+        if err := tx.FindAll(ctx, &ClientInfo{}, &clients); err != nil {
+            return err
+        }
+        if len(clients) > 0 {
+            return fmt.Errorf("%w: found %d", ErrNotFresh, len(clients))
+        }
+
+        for _, table := range export.tables() {
+            records := reflect.ValueOf(table.records).Elem()
+            for i := 0; i < records.Len(); i++ {
+                record := records.Index(i).Addr().Interface()
+
+                var err error
+                if _, ok := record.(*Plan); ok {
+                    err = tx.Upsert(ctx, record)
+                } else {
+                    err = tx.Insert(ctx, record)
+                }
+                if err != nil {
+                    return fmt.Errorf("importing %s: %w", persist.TableName(record), err)
+                }
+
+                imported++
+            }
+        }
+
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    return imported, nil
+}
+
+// Serve an online backup of the database as a download.
+func backupHandler(w http.ResponseWriter, req *http.Request) {
+    dir, err := ioutil.TempDir("", "mutex-backup")
+    if err != nil {
+        reportError(w, req, 500, err.Error())
+
+        return
+    }
+    defer os.RemoveAll(dir)
+
+    now := time.Now()
+    name := fmt.Sprintf("mutex-backup-%s.db", now.UTC().Format("20060102T150405Z"))
+    path := filepath.Join(dir, name)
+    if err = persist.Current().Backup(req.Context(), path); err != nil {
+        if errors.Is(err, persist.ErrUnsupported) {
+            reportError(w, req, 501, err.Error())
+        } else {
+            reportError(w, req, 500, err.Error())
+        }
+
+        return
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        reportError(w, req, 500, err.Error())
+
+        return
+    }
+    defer file.Close()
+
+    w.Header().Set("Content-Type", "application/vnd.sqlite3")
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+    http.ServeContent(w, req, name, now, file)
+}
+
+func exportHandler(w http.ResponseWriter, req *http.Request) {
+    export, err := ExportState()
+    if err != nil {
+        reportError(w, req, 500, err.Error())
+
+        return
+    }
+
+    WriteJSON(w, req, export)
+}
+
+// Import the export in the request body and reacquire its held locks.
+func importHandler(w http.ResponseWriter, req *http.Request) {
+    export := &Export{}
+    if err := json.NewDecoder(req.Body).Decode(export); err != nil {
+        reportError(w, req, 400, fmt.Sprintf("invalid export: %s", err))
+
+        return
+    }
+
+    imported, err := ImportState(export)
+    if err != nil {
+        if errors.Is(err, ErrNotFresh) {
+            reportError(w, req, 409, err.Error())
+        } else {
+            reportError(w, req, 500, err.Error())
+        }
+
+        return
+    }
+
+    restored, err := RestoreHeldLocks()
+    if err != nil {
+        reportError(w, req, 500, err.Error())
+
+        return
+    }
+
+    WriteJSON(w, req, &HttpImport{
+        StatusCode: 200,
+        Imported: imported,
+        RestoredLocks: restored,
+    })
+}
+
+// Run a command given after the flags, instead of the server, and exit:
+//
+//  backup {path}   write an online backup of the SQLite database to path
+//  export {path}   write a JSON export to path (- for standard output)
+//  import {path}   import a JSON export from path (- for standard input)
+//                  into a database without clients
+func runCommand(args []string) {
+    if len(args) != 2 {
+        fatal("usage: mutex [flags] backup|export|import {path}", errors.New("wrong number of arguments"))
+    }
+    command, path := args[0], args[1]
+
+    var err error
+    switch command {
+    case "backup":
+        // backing up needn't migrate the database
+        if err = persist.Open(databaseDSN()); err == nil {
+            err = persist.Backup(path)
+        }
+    case "export":
+        if err = persist.Init(databaseDSN()); err == nil {
+            err = exportTo(path)
+        }
+    case "import":
+        if err = persist.Init(databaseDSN()); err == nil {
+            err = importFrom(path)
+        }
+    default:
+        fatal("unknown command", errors.New(fmt.Sprintf("'%s' (expected backup, export or import)", command)))
+    }
+
+    if err != nil {
+        fatal(command + " failed", err)
+    }
+
+    logger.Info(command + " complete", "path", path)
+    os.Exit(0)
+}
+
+func exportTo(path string) error {
+    export, err := ExportState()
+    if err != nil {
+        return err
+    }
+
+    data, err := JSONMarshal(export)
+    if err != nil {
+        return err
+    }
+
+    if path == "-" {
+        _, err = os.Stdout.Write(data)
+
+        return err
+    }
+
+    return ioutil.WriteFile(path, data, 0600)
+}
+
+// Held locks imported are reacquired when the server next starts.
+func importFrom(path string) error {
+    var reader io.Reader = os.Stdin
+    if path != "-" {
+        file, err := os.Open(path)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        reader = file
+    }
+
+    export := &Export{}
+    if err := json.NewDecoder(reader).Decode(export); err != nil {
+        return fmt.Errorf("invalid export: %w", err)
+    }
+
+    imported, err := ImportState(export)
+    if err == nil {
+        logger.Info("imported records", "count", imported, "heldLocks", len(export.HeldLocks))
+    }
+
+    return err
+}
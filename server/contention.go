@@ -0,0 +1,174 @@
+// Per-mutex contention statistics, for finding the identifiers that cause
+// lock pileups.
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// How many recent wait and hold times are kept per mutex to estimate
+// percentiles from.
+const contentionSamples = 256
+
+// A ring of recent durations.
+type durationSamples struct {
+    values [contentionSamples]time.Duration
+    count int
+    next int
+}
+
+func (s *durationSamples) add(d time.Duration) {
+    s.values[s.next] = d
+    s.next = (s.next + 1) % len(s.values)
+    if s.count < len(s.values) {
+        s.count++
+    }
+}
+
+// The p'th percentile (0 < p <= 1) of the samples, zero if there are none.
+func (s *durationSamples) percentile(p float64) time.Duration {
+    if s.count == 0 {
+        return 0
+    }
+
+    sorted := make([]time.Duration, s.count)
+    copy(sorted, s.values[:s.count])
+    sort.Slice(sorted, func (i, j int) bool {
+        return sorted[i] < sorted[j]
+    })
+
+    i := int(p * float64(s.count) + 0.5) - 1
+    if i < 0 {
+        i = 0
+    } else if i >= s.count {
+        i = s.count - 1
+    }
+
+    return sorted[i]
+}
+
+// Statistics for one mutex, protected by the owning ClientResources.mu.
+// They are evicted along with the mutex.
+type mutexStats struct {
+    acquires int64
+    // lock requests that found the mutex held
+    contended int64
+    timeouts int64
+    maxQueueDepth int
+    waits durationSamples
+    holds durationSamples
+}
+
+type HttpMutexStats struct {
+    Identifier string `json:"identifier"`
+    Acquires int64 `json:"acquires"`
+    Contended int64 `json:"contended"`
+    Timeouts int64 `json:"timeouts"`
+    MaxQueueDepth int `json:"maxQueueDepth"`
+    WaitP50Ms int64 `json:"waitP50Ms"`
+    WaitP99Ms int64 `json:"waitP99Ms"`
+    HoldP50Ms int64 `json:"holdP50Ms"`
+    HoldP99Ms int64 `json:"holdP99Ms"`
+}
+
+const defaultTopMutexes = 10
+const maxTopMutexes = 100
+
+// cr.mu must be held by the caller.
+func (cr *ClientResources) stats(mutexIdentifier string) *mutexStats {
+    stats, ok := cr.mutexStats[mutexIdentifier]
+    if !ok {
+        stats = &mutexStats{}
+        cr.mutexStats[mutexIdentifier] = stats
+    }
+
+    return stats
+}
+
+// Return the statistics of up to top mutexes for which include returns
+// true, most contended first: by how many lock requests had to wait, then
+// how many timed out, then the 99th percentile wait.
+func TopContendedMutexes(resources string, top int, include func (string) bool) []HttpMutexStats {
+    cr := getClientResources(resources)
+    report := []HttpMutexStats{}
+
+    cr.mu.RLock()
+    for identifier, stats := range cr.mutexStats {
+        if !include(identifier) {
+            continue
+        }
+
+        report = append(report, HttpMutexStats{
+            Identifier: identifier,
+            Acquires: stats.acquires,
+            Contended: stats.contended,
+            Timeouts: stats.timeouts,
+            MaxQueueDepth: stats.maxQueueDepth,
+            WaitP50Ms: stats.waits.percentile(0.5).Milliseconds(),
+            WaitP99Ms: stats.waits.percentile(0.99).Milliseconds(),
+            HoldP50Ms: stats.holds.percentile(0.5).Milliseconds(),
+            HoldP99Ms: stats.holds.percentile(0.99).Milliseconds(),
+        })
+    }
+    cr.mu.RUnlock()
+
+    sort.Slice(report, func (i, j int) bool {
+        a, b := report[i], report[j]
+        switch {
+        case a.Contended != b.Contended:
+            return a.Contended > b.Contended
+        case a.Timeouts != b.Timeouts:
+            return a.Timeouts > b.Timeouts
+        case a.WaitP99Ms != b.WaitP99Ms:
+            return a.WaitP99Ms > b.WaitP99Ms
+        default:
+            return a.Identifier < b.Identifier
+        }
+    })
+
+    if len(report) > top {
+        report = report[:top]
+    }
+
+    return report
+}
+
+func apiStatsHandler(w http.ResponseWriter, req *http.Request, apiKey string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+
+    if !checkRequestRate(w, req, credential.Account) {
+        return
+    }
+
+    resources, ok := resolveNamespace(w, req, credential)
+    if !ok {
+        return
+    }
+
+    if req.Method != "GET" {
+        reportError(w, req, 400, "use GET for stats")
+
+        return
+    }
+
+    top := defaultTopMutexes
+    if args := req.URL.Query(); args.Has("top") {
+        if topArg, err := strconv.Atoi(args.Get("top")); err == nil && topArg > 0 {
+            top = topArg
+        }
+    }
+    if top > maxTopMutexes {
+        top = maxTopMutexes
+    }
+
+    // restricted keys only see the mutexes they may check
+    WriteJSON(w, req, TopContendedMutexes(resources, top, func (identifier string) bool {
+        return credential.Allows(OpStatus, identifier)
+    }))
+}
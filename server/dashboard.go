@@ -0,0 +1,113 @@
+// Data for the live dashboard (static/dashboard): the mutexes a client (or,
+// for the admin, every client) holds and waits for, recent audit events and
+// the most contended mutexes.
+package main
+
+import (
+    "net/http"
+    "sort"
+    "time"
+)
+
+type DashboardMutex struct {
+    AdminMutexInfo
+    // the account or namespace the mutex belongs to, in the admin's view
+    Resources string `json:"resources,omitempty"`
+}
+
+type DashboardState struct {
+    Mutexes []DashboardMutex `json:"mutexes"`
+    // newest first
+    Events []AuditEvent `json:"events"`
+    HotSpots []DashboardMutex `json:"hotSpots"`
+}
+
+const dashboardEvents = 50
+const dashboardHotSpots = 5
+const dashboardEventWindow = time.Hour
+
+// Build the dashboard for the given resources (every loaded account and
+// namespace if all is set).
+func dashboardState(resources string, all bool) *DashboardState {
+    state := &DashboardState{
+        Mutexes: []DashboardMutex{},
+        HotSpots: []DashboardMutex{},
+    }
+
+    resourceKeys := []string{resources}
+    if all {
+        resourceKeys = []string{}
+        crmMutex.RLock()
+        for key := range clientResourceMap {
+            resourceKeys = append(resourceKeys, key)
+        }
+        crmMutex.RUnlock()
+        sort.Strings(resourceKeys)
+    }
+
+    for _, key := range resourceKeys {
+        for _, mutexInfo := range ListMutexes(key) {
+            dashboardMutex := DashboardMutex{
+                AdminMutexInfo: mutexInfo,
+            }
+            if all {
+                dashboardMutex.Resources = key
+            }
+
+            state.Mutexes = append(state.Mutexes, dashboardMutex)
+        }
+    }
+
+    for _, dashboardMutex := range state.Mutexes {
+        if dashboardMutex.Waiters > 0 {
+            state.HotSpots = append(state.HotSpots, dashboardMutex)
+        }
+    }
+    sort.SliceStable(state.HotSpots, func (i, j int) bool {
+        return state.HotSpots[i].Waiters > state.HotSpots[j].Waiters
+    })
+    if len(state.HotSpots) > dashboardHotSpots {
+        state.HotSpots = state.HotSpots[:dashboardHotSpots]
+    }
+
+    if all {
+        resources = ""
+    }
+    since := time.Now().Add(-dashboardEventWindow).UnixMilli()
+    events, err := FindAuditEvents(resources, "", since, dashboardEvents)
+    if err != nil {
+        logger.Error("unable to read dashboard events", "error", err)
+        events = []AuditEvent{}
+    }
+    state.Events = events
+
+    return state
+}
+
+func apiDashboardHandler(w http.ResponseWriter, req *http.Request, apiKey string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+
+    if !checkRequestRate(w, req, credential.Account) {
+        return
+    }
+
+    if !authorize(w, req, credential, OpAudit, "") {
+        return
+    }
+
+    resources, ok := resolveNamespace(w, req, credential)
+    if !ok {
+        return
+    }
+
+    if req.Method != "GET" {
+        reportError(w, req, 400, "use GET for dashboard")
+
+        return
+    }
+
+    WriteJSON(w, req, dashboardState(resources, false))
+}
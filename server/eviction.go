@@ -0,0 +1,118 @@
+// Eviction of idle resources. Mutexes and rate limiters that haven't been
+// used for -idleTTL are dropped, as are clients with no resources left, so
+// that memory is bounded by recent activity. Held or awaited mutexes and
+// rate limiters with requests waiting on them are never evicted.
+package main
+
+import (
+    "time"
+)
+
+type EvictionResult struct {
+    Mutexes int `json:"mutexes"`
+    RateLimiters int `json:"rateLimiters"`
+    Clients int `json:"clients"`
+}
+
+// Return the resources for account with cr.mu locked, marked as used.
+// Functions that modify resources must use this rather than
+// getClientResources, since resources evicted between being looked up and
+// locked must not be modified.
+func lockClientResources(account string) *ClientResources {
+    for {
+        cr := getClientResources(account)
+        cr.mu.Lock()
+
+        if !cr.evicted {
+            cr.lastUsed = time.Now()
+
+            return cr
+        }
+
+        cr.mu.Unlock()
+    }
+}
+
+// Evict mutexes, rate limiters and clients that haven't been used for ttl.
+func EvictIdle(ttl time.Duration) EvictionResult {
+    var result EvictionResult
+    cutoff := time.Now().Add(-ttl)
+
+    crmMutex.RLock()
+    resources := make(map[string]*ClientResources, len(clientResourceMap))
+    for account, cr := range clientResourceMap {
+        resources[account] = cr
+    }
+    crmMutex.RUnlock()
+
+    idle := []string{}
+    for account, cr := range resources {
+        cr.mu.Lock()
+        for identifier, state := range cr.semaphoreMap {
+            if state.holder == 0 && state.waiters == 0 && !state.lastUsed.After(cutoff) {
+                delete(cr.semaphoreMap, identifier)
+                delete(cr.mutexStats, identifier)
+                result.Mutexes++
+            }
+        }
+
+        // a limiter is only evicted once it has refilled, since a new one
+        // would start full
+        for identifier, limiter := range cr.rateLimiterMap {
+            if limiter.takers == 0 && !limiter.lastUsed.After(cutoff) && limiter.bucket.Full() {
+                delete(cr.rateLimiterMap, identifier)
+                result.RateLimiters++
+            }
+        }
+
+        if cr.idle(cutoff) {
+            idle = append(idle, account)
+        }
+        cr.mu.Unlock()
+    }
+
+    if len(idle) > 0 {
+        crmMutex.Lock()
+        for _, account := range idle {
+            cr := resources[account]
+            if clientResourceMap[account] != cr {
+                continue
+            }
+
+            // the client may have been used since it was found idle
+            cr.mu.Lock()
+            if cr.idle(cutoff) {
+                cr.evicted = true
+                delete(clientResourceMap, account)
+                result.Clients++
+            }
+            cr.mu.Unlock()
+        }
+        crmMutex.Unlock()
+    }
+
+    return result
+}
+
+// Report whether resources have nothing worth keeping and haven't been used
+// since cutoff. cr.mu must be held by the caller.
+func (cr *ClientResources) idle(cutoff time.Time) bool {
+    return len(cr.semaphoreMap) == 0 && len(cr.rateLimiterMap) == 0 && cr.heldMutexes == 0 &&
+            !cr.lastUsed.After(cutoff)
+}
+
+func EvictionDaemon() {
+    for {
+        time.Sleep(PurgeInterval)
+
+        result := EvictIdle(IdleTTL)
+        now := time.Now()
+        sweepKeyCache(now)
+        sweepNamespaceAccessCache(now)
+        sweepRegistrations(now)
+        sweepAuditEvents(now)
+
+        logger.Debug("evicted idle resources", "mutexes", result.Mutexes,
+                "rate_limiters", result.RateLimiters, "clients", result.Clients)
+    }
+}
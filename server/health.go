@@ -0,0 +1,128 @@
+// Health, readiness and version endpoints for load balancers and
+// orchestrators. None of them require a credential.
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "runtime"
+    "runtime/debug"
+    "time"
+
+    "mutex/server/persist"
+)
+
+// Build information, set at link time, e.g.
+//   go build -ldflags "-X main.version=1.2.0 -X main.buildTime=2024-06-01T00:00:00Z"
+// The commit defaults to the one recorded by the go tool when built from a
+// git checkout.
+var (
+    version = "dev"
+    commit = ""
+    buildTime = ""
+)
+
+type HttpHealth struct {
+    StatusCode int `json:"statusCode"`
+    Status string `json:"status"`
+}
+
+type HttpReadiness struct {
+    StatusCode int `json:"statusCode"`
+    Ready bool `json:"ready"`
+    Database string `json:"database"`
+    Draining bool `json:"draining"`
+}
+
+type HttpVersion struct {
+    Version string `json:"version"`
+    Commit string `json:"commit,omitempty"`
+    BuildTime string `json:"buildTime,omitempty"`
+    GoVersion string `json:"goVersion"`
+}
+
+// How long the readiness probe waits for the database to answer.
+var readyzPingTimeout = 2 * time.Second
+
+// Paths polled by probes, whose requests are logged at debug level.
+var probePaths = map[string]bool{
+    "/healthz": true,
+    "/readyz": true,
+}
+
+// The process is alive if it can answer at all.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+    WriteJSON(w, req, &HttpHealth{
+        StatusCode: 200,
+        Status: "ok",
+    })
+}
+
+// The server is ready for traffic when its database is reachable and it
+// isn't shutting down.
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+    readiness := &HttpReadiness{
+        StatusCode: 200,
+        Ready: true,
+        Database: "ok",
+        Draining: Draining(),
+    }
+
+    if err := pingDatabase(req.Context()); err != nil {
+        // the error may describe the database, so it's only logged
+        requestLogger(req.Context()).Warn("database unreachable", "error", err)
+        readiness.Database = "unavailable"
+        readiness.Ready = false
+    }
+
+    if readiness.Draining {
+        readiness.Ready = false
+    }
+
+    if !readiness.Ready {
+        readiness.StatusCode = 503
+        w.Header().Set("Retry-After", drainRetryAfter)
+        w.WriteHeader(503)
+    }
+
+    WriteJSON(w, req, readiness)
+}
+
+func pingDatabase(ctx context.Context) error {
+    store := persist.Current()
+    if store == nil {
+        return errors.New("database not initialized")
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, readyzPingTimeout)
+    defer cancel()
+
+    return store.Ping(ctx)
+}
+
+func versionHandler(w http.ResponseWriter, req *http.Request) {
+    WriteJSON(w, req, buildVersion())
+}
+
+func buildVersion() *HttpVersion {
+    buildVersion := &HttpVersion{
+        Version: version,
+        Commit: commit,
+        BuildTime: buildTime,
+        GoVersion: runtime.Version(),
+    }
+
+    if info, ok := debug.ReadBuildInfo(); ok {
+        for _, setting := range info.Settings {
+            switch {
+            case setting.Key == "vcs.revision" && buildVersion.Commit == "":
+                buildVersion.Commit = setting.Value
+            case setting.Key == "vcs.time" && buildVersion.BuildTime == "":
+                buildVersion.BuildTime = setting.Value
+            }
+        }
+    }
+
+    return buildVersion
+}
@@ -0,0 +1,642 @@
+// API key lifecycle: accounts hold any number of named keys which can be
+// created, rotated and revoked independently.
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "strings"
+    "errors"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "time"
+
+    "github.com/google/uuid"
+    "mutex/server/persist"
+)
+
+const primaryKeyName = "primary"
+
+// An API key as returned to its owner. Keys are only ever disclosed when
+// they are created.
+type ApiKey struct {
+    Key string `json:"apiKey" db-pk:"true"`
+    Email string `json:"email"`
+    Name string `json:"name"`
+    Created int64 `json:"created"`
+}
+
+// The stored form of an API key: a salted hash of the key plus a short
+// public prefix of it to find the record by.
+type KeyRecord struct {
+    Hash string `db-pk:"true"`
+    Prefix string
+    Salt string
+    Email string
+    Name string
+    Created int64
+}
+
+// Revocations are recorded in their own table so that key records are
+// never modified once written.
+type KeyRevocation struct {
+    Hash string `db-pk:"true"`
+    Revoked int64
+}
+
+// Earlier versions stored keys in plaintext (in the ApiKey table and as
+// ClientInfo.ClientID) and recorded revocations by key. These are only
+// read by migratePlaintextKeys.
+type RevokedKey struct {
+    Key string `db-pk:"true"`
+    Revoked int64
+}
+
+// Restrictions on a scoped key: it may only be used on identifiers
+// beginning with Prefix, for the comma separated Operations (all
+// operations if empty), until Expires (never if zero).
+type KeyScope struct {
+    Hash string `db-pk:"true"`
+    Prefix string
+    Operations string
+    Expires int64
+}
+
+// The operations a key can be restricted to.
+const (
+    OpStatus = "status"
+    OpLock = "lock"
+    OpTake = "take"
+    // only unrestricted keys may manage keys and namespaces or read the
+    // audit log
+    OpKeys = "keys"
+    OpNamespaces = "namespaces"
+    OpAudit = "audit"
+)
+
+var scopedOperations = []string{OpStatus, OpLock, OpTake}
+
+// What an account may see of its keys when listing them.
+type ApiKeyInfo struct {
+    Name string `json:"name"`
+    KeyPrefix string `json:"keyPrefix"`
+    Created int64 `json:"created"`
+    Revoked int64 `json:"revoked,omitempty"`
+    Scope string `json:"scope,omitempty"`
+    Operations string `json:"operations,omitempty"`
+    Expires int64 `json:"expires,omitempty"`
+}
+
+// The account a verified key belongs to and what the key may do there.
+type Credential struct {
+    Account string
+    Scope *KeyScope
+}
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+type keyCacheEntry struct {
+    credential *Credential
+    expires time.Time
+}
+
+var keyCacheMutex sync.RWMutex
+var keyCache = map[string]keyCacheEntry{}
+
+// Serializes creating, revoking and rotating keys, whose checks for active
+// keys of the same name (or the last unrestricted key) need a consistent
+// view that not every database's transactions provide.
+var keyChangeMutex sync.Mutex
+
+// Drop expired entries from the key cache.
+func sweepKeyCache(now time.Time) {
+    keyCacheMutex.Lock()
+    defer keyCacheMutex.Unlock()
+
+    for key, entry := range keyCache {
+        if now.After(entry.expires) {
+            delete(keyCache, key)
+        }
+    }
+}
+
+// The first few characters of a key, enough to tell keys apart without
+// disclosing them.
+func keyPrefix(key string) string {
+    if len(key) > 8 {
+        return key[:8]
+    }
+
+    return key
+}
+
+func hashKey(salt string, key string) string {
+    hash := sha256.Sum256([]byte(salt + key))
+
+    return hex.EncodeToString(hash[:])
+}
+
+func newKeyRecord(apiKey *ApiKey) (*KeyRecord, error) {
+    salt := make([]byte, 16)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+
+    keyRecord := &KeyRecord{
+        Prefix: keyPrefix(apiKey.Key),
+        Salt: hex.EncodeToString(salt),
+        Email: apiKey.Email,
+        Name: apiKey.Name,
+        Created: apiKey.Created,
+    }
+    keyRecord.Hash = hashKey(keyRecord.Salt, apiKey.Key)
+
+    return keyRecord, nil
+}
+
+// Store a new key in the transaction tx, restricted to scope if it isn't
+// nil.
+func insertApiKey(ctx context.Context, tx persist.Records, apiKey *ApiKey, scope *KeyScope) error {
+    keyRecord, err := newKeyRecord(apiKey)
+    if err != nil {
+        return err
+    }
+
+    if err = tx.Insert(ctx, keyRecord); err != nil {
+        return err
+    }
+
+    if scope == nil {
+        return nil
+    }
+
+    scope.Hash = keyRecord.Hash
+
+    return tx.Insert(ctx, scope)
+}
+
+func findKeyScope(ctx context.Context, records persist.Records, keyRecord *KeyRecord) *KeyScope {
+    scope := KeyScope{
+        Hash: keyRecord.Hash,
+    }
+
+    if keyRecord.Hash == "" || records.Find(ctx, &scope) != nil {
+        return nil
+    }
+
+    return &scope
+}
+
+// Build a key scope from its request parameters, returning nil if the key
+// is unrestricted.
+func NewKeyScope(prefix string, operations string, expiresIn time.Duration) (*KeyScope, error) {
+    if prefix == "" && operations == "" && expiresIn == 0 {
+        return nil, nil
+    }
+
+    scope := &KeyScope{
+        // "billing/*" and "billing/" are the same scope
+        Prefix: strings.TrimSuffix(prefix, "*"),
+    }
+
+    if operations != "" {
+        for _, op := range strings.Split(operations, ",") {
+            if !containsString(scopedOperations, op) {
+                return nil, errors.New(fmt.Sprintf("unknown operation '%s' (expected one of %s)",
+                        op, strings.Join(scopedOperations, ", ")))
+            }
+        }
+        scope.Operations = operations
+    }
+
+    if expiresIn < 0 {
+        return nil, errors.New("key expiry must be in the future")
+    } else if expiresIn > 0 {
+        scope.Expires = time.Now().Add(expiresIn).Unix()
+    }
+
+    return scope, nil
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Report whether the credential may perform op on the named resource.
+// Managing keys requires an unrestricted key.
+func (c *Credential) Allows(op string, identifier string) bool {
+    if c.Scope == nil {
+        return true
+    }
+
+    if c.Scope.Operations != "" && !containsString(strings.Split(c.Scope.Operations, ","), op) {
+        return false
+    }
+
+    return containsString(scopedOperations, op) && strings.HasPrefix(identifier, c.Scope.Prefix)
+}
+
+func (c *Credential) expired() bool {
+    return c.Scope != nil && c.Scope.Expires != 0 && time.Now().Unix() >= c.Scope.Expires
+}
+
+// Find the record for a key by its prefix, then check the key against each
+// candidate's hash in constant time.
+func findKeyRecord(key string) *KeyRecord {
+    found, _ := findKeyRecordIn(context.Background(), persist.Current(), key)
+
+    return found
+}
+
+// Find the record for a key using records, which may be a transaction.
+func findKeyRecordIn(ctx context.Context, records persist.Records, key string) (*KeyRecord, error) {
+    candidates := []KeyRecord{}
+    if err := records.FindAll(ctx, &KeyRecord{
+        Prefix: keyPrefix(key),
+    }, &candidates); err != nil {
+        return nil, err
+    }
+
+    var found *KeyRecord
+    for i := range candidates {
+        hash := hashKey(candidates[i].Salt, key)
+        if subtle.ConstantTimeCompare([]byte(hash), []byte(candidates[i].Hash)) == 1 {
+            found = &candidates[i]
+        }
+    }
+
+    return found, nil
+}
+
+// Return when the key was revoked, or zero if it hasn't been. If that
+// can't be determined the key must be treated as revoked.
+func keyRevoked(ctx context.Context, records persist.Records, keyRecord *KeyRecord) (int64, error) {
+    revocation := KeyRevocation{
+        Hash: keyRecord.Hash,
+    }
+
+    if keyRecord.Hash == "" {
+        return 0, nil
+    }
+
+    if err := records.Find(ctx, &revocation); err != nil {
+        if errors.Is(err, persist.ErrNotFound) {
+            return 0, nil
+        }
+
+        return 0, err
+    }
+
+    return revocation.Revoked, nil
+}
+
+func findAccountKeys(ctx context.Context, records persist.Records, account string) ([]KeyRecord, error) {
+    keyRecords := []KeyRecord{}
+    if err := records.FindAll(ctx, &KeyRecord{
+        Email: account,
+    }, &keyRecords); err != nil {
+        return nil, err
+    }
+
+    return keyRecords, nil
+}
+
+func findActiveKeys(ctx context.Context, records persist.Records, account string) ([]KeyRecord, error) {
+    keyRecords, err := findAccountKeys(ctx, records, account)
+    if err != nil {
+        return nil, err
+    }
+
+    active := []KeyRecord{}
+    for _, keyRecord := range keyRecords {
+        revoked, err := keyRevoked(ctx, records, &keyRecord)
+        if err != nil {
+            return nil, err
+        }
+
+        if revoked == 0 {
+            active = append(active, keyRecord)
+        }
+    }
+
+    return active, nil
+}
+
+// Return the account's active key named name, or ErrKeyNotFound.
+func findActiveKey(ctx context.Context, records persist.Records, account string, name string) (*KeyRecord, error) {
+    active, err := findActiveKeys(ctx, records, account)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, keyRecord := range active {
+        if keyRecord.Name == name {
+            return &keyRecord, nil
+        }
+    }
+
+    return nil, fmt.Errorf("%w: '%s'", ErrKeyNotFound, name)
+}
+
+// Verify an API key, returning the account it belongs to and any
+// restrictions on its use. Valid keys are cached for -keyCacheTTL; revoking
+// a key evicts it from the cache immediately.
+func VerifyClient(key string) (*Credential, bool) {
+    keyCacheMutex.RLock()
+    entry, ok := keyCache[key]
+    keyCacheMutex.RUnlock()
+
+    if ok && time.Now().Before(entry.expires) {
+        return entry.credential, !entry.credential.expired()
+    }
+
+    keyRecord := findKeyRecord(key)
+    if keyRecord == nil {
+        return nil, false
+    }
+
+    if revoked, err := keyRevoked(context.Background(), persist.Current(), keyRecord); err != nil || revoked != 0 {
+        if err != nil {
+            logger.Error("unable to check key revocation", "error", err, "account", keyRecord.Email)
+        }
+
+        return nil, false
+    }
+
+    credential := &Credential{
+        Account: keyRecord.Email,
+        Scope: findKeyScope(context.Background(), persist.Current(), keyRecord),
+    }
+
+    if credential.expired() {
+        return nil, false
+    }
+
+    keyCacheMutex.Lock()
+    keyCache[key] = keyCacheEntry{
+        credential: credential,
+        expires: time.Now().Add(KeyCacheTTL),
+    }
+    keyCacheMutex.Unlock()
+
+    _ = getClientResources(keyRecord.Email)
+
+    return credential, true
+}
+
+func ListApiKeys(account string) ([]ApiKeyInfo, error) {
+    ctx := context.Background()
+    keyRecords, err := findAccountKeys(ctx, persist.Current(), account)
+    if err != nil {
+        return nil, err
+    }
+
+    keyInfos := []ApiKeyInfo{}
+    for _, keyRecord := range keyRecords {
+        revoked, err := keyRevoked(ctx, persist.Current(), &keyRecord)
+        if err != nil {
+            return nil, err
+        }
+
+        keyInfo := ApiKeyInfo{
+            Name: keyRecord.Name,
+            KeyPrefix: keyRecord.Prefix,
+            Created: keyRecord.Created,
+            Revoked: revoked,
+        }
+
+        if scope := findKeyScope(ctx, persist.Current(), &keyRecord); scope != nil {
+            keyInfo.Scope = scope.Prefix
+            keyInfo.Operations = scope.Operations
+            keyInfo.Expires = scope.Expires
+        }
+
+        keyInfos = append(keyInfos, keyInfo)
+    }
+
+    return keyInfos, nil
+}
+
+// Create a new key for the account, restricted to scope if it isn't nil.
+func CreateApiKey(account string, name string, scope *KeyScope) (*ApiKey, error) {
+    if name == "" {
+        return nil, errors.New("api key name is required")
+    }
+
+    apiKey := &ApiKey{
+        Key: uuid.New().String(),
+        Email: account,
+        Name: name,
+        Created: time.Now().Unix(),
+    }
+
+    keyChangeMutex.Lock()
+    defer keyChangeMutex.Unlock()
+
+    ctx := context.Background()
+    if err := persist.WithTx(ctx, func (tx persist.Records) error {
+        if _, err := findActiveKey(ctx, tx, account, name); err == nil {
+            return errors.New(fmt.Sprintf("api key '%s' already exists", name))
+        } else if !errors.Is(err, ErrKeyNotFound) {
+            return err
+        }
+
+        return insertApiKey(ctx, tx, apiKey, scope)
+    }); err != nil {
+        return nil, err
+    }
+
+    return apiKey, nil
+}
+
+func revokeApiKey(ctx context.Context, tx persist.Records, keyRecord *KeyRecord) error {
+    return tx.Insert(ctx, &KeyRevocation{
+        Hash: keyRecord.Hash,
+        Revoked: time.Now().Unix(),
+    })
+}
+
+// Drop a revoked key from the key cache. Only the key's hash is known, so
+// every cached key with the same prefix is dropped and the survivors are
+// verified again.
+func forgetRevokedKey(keyRecord *KeyRecord) {
+    keyCacheMutex.Lock()
+    for key := range keyCache {
+        if keyPrefix(key) == keyRecord.Prefix {
+            delete(keyCache, key)
+        }
+    }
+    keyCacheMutex.Unlock()
+}
+
+// Revoke the named key. An account's last active unrestricted key can't be
+// revoked since the account would be locked out of managing its keys.
+func RevokeApiKey(account string, name string) error {
+    keyChangeMutex.Lock()
+    defer keyChangeMutex.Unlock()
+
+    var keyRecord *KeyRecord
+    ctx := context.Background()
+    if err := persist.WithTx(ctx, func (tx persist.Records) error {
+        active, err := findActiveKeys(ctx, tx, account)
+        if err != nil {
+            return err
+        }
+
+        unrestricted := 0
+        for i := range active {
+            if active[i].Name == name {
+                keyRecord = &active[i]
+            }
+
+            if findKeyScope(ctx, tx, &active[i]) == nil {
+                unrestricted++
+            }
+        }
+
+        if keyRecord == nil {
+            return fmt.Errorf("%w: '%s'", ErrKeyNotFound, name)
+        }
+
+        if findKeyScope(ctx, tx, keyRecord) == nil && unrestricted <= 1 {
+            return errors.New(fmt.Sprintf("api key '%s' is the last active unrestricted key (create another first)",
+                    name))
+        }
+
+        return revokeApiKey(ctx, tx, keyRecord)
+    }); err != nil {
+        return err
+    }
+
+    forgetRevokedKey(keyRecord)
+
+    return nil
+}
+
+// Replace the named key with a new one of the same name and scope, revoking
+// the old key.
+func RotateApiKey(account string, name string) (*ApiKey, error) {
+    newKey := &ApiKey{
+        Key: uuid.New().String(),
+        Email: account,
+        Name: name,
+        Created: time.Now().Unix(),
+    }
+
+    keyChangeMutex.Lock()
+    defer keyChangeMutex.Unlock()
+
+    // the new key is inserted and the old one revoked together, so a
+    // failure can't leave both active
+    var oldKey *KeyRecord
+    ctx := context.Background()
+    if err := persist.WithTx(ctx, func (tx persist.Records) error {
+        var err error
+        if oldKey, err = findActiveKey(ctx, tx, account, name); err != nil {
+            return err
+        }
+
+        scope := findKeyScope(ctx, tx, oldKey)
+        if scope != nil {
+            scope.Hash = ""
+        }
+
+        if err = insertApiKey(ctx, tx, newKey, scope); err != nil {
+            return err
+        }
+
+        return revokeApiKey(ctx, tx, oldKey)
+    }); err != nil {
+        return nil, err
+    }
+
+    forgetRevokedKey(oldKey)
+
+    return newKey, nil
+}
+
+// Replace the plaintext keys stored by earlier versions with hashed key
+// records, keeping their revocations, and clear the registration keys
+// recorded on ClientInfo. Run once, by migration 5, in its transaction;
+// migration 6 then drops the plaintext tables.
+func migratePlaintextKeys(ctx context.Context, tx persist.Records) error {
+    plaintextKeys := []ApiKey{}
+    if err := tx.FindAll(ctx, &ApiKey{}, &plaintextKeys); err != nil {
+        return err
+    }
+
+    // accounts registered before named keys only have their registration
+    // key, recorded on their ClientInfo
+    clientInfos := []ClientInfo{}
+    if err := tx.FindAll(ctx, &ClientInfo{}, &clientInfos); err != nil {
+        return err
+    }
+    for _, clientInfo := range clientInfos {
+        if clientInfo.ClientID != "" {
+            plaintextKeys = append(plaintextKeys, ApiKey{
+                Key: clientInfo.ClientID,
+                Email: clientInfo.Email,
+                Name: primaryKeyName,
+                Created: time.Now().Unix(),
+            })
+        }
+    }
+
+    if len(plaintextKeys) > 0 {
+        logger.Info("hashing plaintext keys", "count", len(plaintextKeys))
+    }
+
+    for i := range plaintextKeys {
+        apiKey := &plaintextKeys[i]
+        keyRecord, err := findKeyRecordIn(ctx, tx, apiKey.Key)
+        if err != nil {
+            return err
+        }
+        if keyRecord != nil {
+            continue
+        }
+
+        if err = insertApiKey(ctx, tx, apiKey, nil); err != nil {
+            return err
+        }
+
+        revokedKey := RevokedKey{
+            Key: apiKey.Key,
+        }
+        if err = tx.Find(ctx, &revokedKey); errors.Is(err, persist.ErrNotFound) {
+            continue
+        } else if err != nil {
+            return err
+        }
+
+        if keyRecord, err = findKeyRecordIn(ctx, tx, apiKey.Key); err != nil {
+            return err
+        }
+        if err = tx.Insert(ctx, &KeyRevocation{
+            Hash: keyRecord.Hash,
+            Revoked: revokedKey.Revoked,
+        }); err != nil {
+            return err
+        }
+    }
+
+    for _, clientInfo := range clientInfos {
+        if clientInfo.ClientID != "" {
+            clientInfo.ClientID = ""
+            if err := tx.Update(ctx, &clientInfo); err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
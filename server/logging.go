@@ -0,0 +1,84 @@
+// Structured logging and the request IDs that tie a request's log entries
+// together.
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "mutex/server/logging"
+    "mutex/server/tracing"
+)
+
+var logger = logging.New(os.Stderr, logging.Info)
+
+// Client-supplied request IDs are used only if they're short and can't be
+// used to forge log entries.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// The logger for a request, carrying its request ID.
+func requestLogger(ctx context.Context) *logging.Logger {
+    return logging.FromContext(ctx, logger)
+}
+
+// The ID of the request ctx belongs to, or "" outside a request.
+func requestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+
+    return id
+}
+
+// The request path as logged, with any API key in a legacy path redacted.
+func logPath(path string) string {
+    pathParams := strings.Split(path, "/")
+
+    if len(pathParams) >= 4 && pathParams[1] == "api" && pathParams[2] == "client" {
+        pathParams[3] = redactKey(pathParams[3])
+    }
+
+    return strings.Join(pathParams, "/")
+}
+
+// Assign every request an ID, taken from its X-Request-Id header if it has
+// a usable one, return it to the client in the same header and log the
+// request once it completes.
+func requestIDHandler(next http.Handler) http.Handler {
+    return http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
+        requestID := req.Header.Get("X-Request-Id")
+        if !requestIDPattern.MatchString(requestID) {
+            requestID = uuid.New().String()
+        }
+        w.Header().Set("X-Request-Id", requestID)
+
+        reqLogger := logger.With("request_id", requestID)
+        if span := tracing.SpanFromContext(req.Context()); span != nil {
+            reqLogger = reqLogger.With("trace_id", span.SpanContext().TraceID.String())
+        }
+        ctx := context.WithValue(req.Context(), requestIDKey{}, requestID)
+        req = req.WithContext(logging.NewContext(ctx, reqLogger))
+
+        start := time.Now()
+        recorder := &statusRecorder{ResponseWriter: w}
+
+        next.ServeHTTP(recorder, req)
+
+        if recorder.statusCode == 0 {
+            recorder.statusCode = 200
+        }
+
+        level := logging.Info
+        if probePaths[req.URL.Path] {
+            level = logging.Debug
+        }
+        reqLogger.Log(level, "request", "method", req.Method, "path", logPath(req.URL.Path),
+                "status", recorder.statusCode, "duration_ms", time.Since(start).Milliseconds(),
+                "remote_addr", req.RemoteAddr)
+    })
+}
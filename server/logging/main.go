@@ -0,0 +1,179 @@
+// Package logging writes leveled, structured log entries as JSON lines.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+
+	return Info, fmt.Errorf("unknown log level '%s' (expected one of %s)", name,
+		strings.Join(levelNames, ", "))
+}
+
+// The destination and minimum level shared by a logger and everything
+// derived from it with With.
+type sink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// A Logger writes entries at or above its level, each carrying the logger's
+// fields in addition to its own.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		sink: &sink{
+			w:     w,
+			level: level,
+		},
+	}
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.level = level
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	return level >= l.sink.level
+}
+
+// Return a logger that adds the given key/value pairs to every entry.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{
+		sink:   l.sink,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.Log(Debug, msg, keyvals...) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.Log(Info, msg, keyvals...) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.Log(Warn, msg, keyvals...) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.Log(Error, msg, keyvals...) }
+
+func writeField(entry *bytes.Buffer, key string, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	} else if stringer, ok := value.(fmt.Stringer); ok {
+		value = stringer.String()
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	keyData, _ := json.Marshal(key)
+	entry.WriteByte(',')
+	entry.Write(keyData)
+	entry.WriteByte(':')
+	entry.Write(data)
+}
+
+// Write an entry with the logger's fields followed by keyvals, which
+// alternate between string keys and values.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := &bytes.Buffer{}
+	entry.WriteString(`{"time":`)
+	timeData, _ := json.Marshal(time.Now().UTC().Format(time.RFC3339Nano))
+	entry.Write(timeData)
+	writeField(entry, "level", level.String())
+	writeField(entry, "msg", msg)
+
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		writeField(entry, key, value)
+	}
+	entry.WriteString("}\n")
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+
+	l.sink.w.Write(entry.Bytes())
+}
+
+// An io.Writer that logs each write as an entry at the given level, for
+// redirecting the standard library logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		l.Log(level, strings.TrimRight(string(p), "\n"))
+
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// Return the logger stored in ctx, or fallback if there isn't one.
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+
+	return fallback
+}
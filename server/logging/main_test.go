@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := New(&buffer, Info)
+
+	logger.Debug("hidden")
+	if buffer.Len() != 0 {
+		t.Fatalf("debug entry written at info level: %s", buffer.String())
+	}
+
+	requestLogger := logger.With("request_id", "abc123")
+	requestLogger.Warn("lock failed", "status", 409, "error", errors.New("wait timeout expired"))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &entry); err != nil {
+		t.Fatalf("entry is not valid JSON: %v\n%s", err, buffer.String())
+	}
+
+	for key, expected := range map[string]interface{}{
+		"level":      "warn",
+		"msg":        "lock failed",
+		"request_id": "abc123",
+		"status":     float64(409),
+		"error":      "wait timeout expired",
+	} {
+		if entry[key] != expected {
+			t.Errorf("entry[%q] = %v, expected %v", key, entry[key], expected)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	fallback := New(&bytes.Buffer{}, Info)
+	logger := fallback.With("request_id", "abc123")
+
+	if FromContext(context.Background(), fallback) != fallback {
+		t.Errorf("FromContext without logger: expected fallback")
+	}
+
+	if FromContext(NewContext(context.Background(), logger), fallback) != logger {
+		t.Errorf("FromContext: expected stored logger")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != Warn {
+		t.Errorf("ParseLevel(WARN) = %v, %v", level, err)
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel(verbose): expected error")
+	}
+}
@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Mailer delivers plain text email messages.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// SMTPMailer sends messages through an SMTP server.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Create an SMTP mailer for the server at addr (host:port). If username is
+// empty messages are sent without authenticating.
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	m := &SMTPMailer{
+		Addr: addr,
+		From: from,
+	}
+
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+func formatMessage(from string, to string, subject string, body string) []byte {
+	message := strings.Builder{}
+	message.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	message.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	message.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
+	message.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return []byte(message.String())
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to},
+		formatMessage(m.From, to, subject, body))
+}
+
+// WriterMailer writes messages to an io.Writer instead of sending them, as
+// a stand-in for SMTP during development and testing.
+type WriterMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{
+		w: w,
+	}
+}
+
+// Create a mailer that appends messages to the file at path.
+func NewFileMailer(path string) (*WriterMailer, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterMailer(file), nil
+}
+
+// Create a mailer that writes messages to the standard logger.
+func NewLogMailer() *WriterMailer {
+	return NewWriterMailer(log.Writer())
+}
+
+// Write the message followed by a terminating "." line. The message is
+// written in a single Write so that a logger sees it as one entry.
+func (m *WriterMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	message := append(formatMessage("mutex.us", to, subject, body), "\r\n.\r\n"...)
+	_, err := m.w.Write(message)
+
+	return err
+}
@@ -0,0 +1,23 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriterMailer(t *testing.T) {
+	var buffer bytes.Buffer
+	m := NewWriterMailer(&buffer)
+
+	if err := m.Send("noreply@mutex.us", "Test", "line one\nline two"); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+
+	message := buffer.String()
+	for _, expected := range []string{"To: noreply@mutex.us\r\n", "Subject: Test\r\n", "line one\r\nline two"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message missing %q:\n%s", expected, message)
+		}
+	}
+}
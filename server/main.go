@@ -3,53 +3,107 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
     "io/ioutil"
 	"strings"
 	"net/http"
+	"net/url"
 
+	"mutex/server/logging"
+	"mutex/server/mailer"
 	"mutex/server/persist"
 
     "github.com/gomarkdown/markdown"
 )
 
+// Log an error that prevents the server from running and exit.
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
 	if ConfigError != nil {
 		log.Fatalf(ConfigErrorText)
 	}
 
-	log.Printf("sqlite database path: %s", *DbPath)
-    err := persist.Init(*DbPath)
+	// route the standard logger (used by packages and net/http) through
+	// the structured logger
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Info))
+
+	logger.Info("opening database", "dsn", redactedDSN())
+    if *MigrateDryRun {
+        migrateDryRun()
+    }
+
+    if args := flagSet.Args(); len(args) > 0 {
+        runCommand(args)
+    }
+
+    if *RequireEmailVerification && *BaseURL == "" {
+        fatal("invalid configuration", errors.New("-requireEmailVerification requires -baseURL, the public URL " +
+                "verification links are sent to"))
+    }
+
+    if *RequireEmailVerification && *Mailer == "" {
+        fatal("invalid configuration", errors.New("-requireEmailVerification requires -mailer, how verification " +
+                "links are delivered"))
+    }
+
+    if *Mailer == "log" {
+        logger.Warn("-mailer log writes verification links to the server log; use it only for development")
+    }
+
+    err := persist.Init(databaseDSN())
     if err != nil {
-        log.Fatal(err)
+        fatal("unable to open database", err)
     }
 
-	log.Printf("adminID is %s", *AdminID)
+    if siteMailer, err = newSiteMailer(); err != nil {
+        fatal("unable to configure mailer", err)
+    }
 
-	mux := http.NewServeMux()
+    if restored, err := RestoreHeldLocks(); err != nil {
+        fatal("unable to restore held locks", err)
+    } else if restored > 0 {
+        logger.Info("restored held locks", "count", restored)
+    }
 
-	mux.HandleFunc("/stats", statsHandler)
-	mux.HandleFunc("/api/client/", func (w http.ResponseWriter, req *http.Request) {
-		path := req.URL.Path
-		pathParams := strings.Split(path, "/")
-		if len(pathParams) >= 6 && pathParams[4] == "mutex" {
-			apiMutexHandler(w, req, pathParams[3], strings.Join(pathParams[5:], "/"))
-		} else {
-			w.WriteHeader(404)
-		}
-	})
-	mux.HandleFunc("/api/client", apiClientHandler)
-	mux.HandleFunc("/", mainHandler)
+	tracer = newTracer()
+
+	go EvictionDaemon()
+
+	// the credential itself is never logged
+	if AdminIDGenerated {
+		logger.Warn("no -adminID set: admin functions are unavailable until the server is restarted with one")
+	} else {
+		logger.Info("admin credential", "adminID", redactKey(*AdminID))
+	}
+
+	buildVersion := buildVersion()
+	logger.Info("mutex server", "version", buildVersion.Version, "commit", buildVersion.Commit)
+
+	mux := newServeMux()
+	servers := []*http.Server{}
 
 	if len(*Addr) > 0 {
 		server := &http.Server{
 			Addr: *Addr,
 			Handler: mux,
 		}
+		servers = append(servers, server)
 
-		log.Printf("Starting HTTP server on %q", *Addr)
+		logger.Info("starting HTTP server", "addr", *Addr)
 		go func() {
-			log.Fatal(server.ListenAndServe())
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("HTTP server failed", err)
+			}
 		}()
 	}
 
@@ -59,20 +113,163 @@ func main() {
 			Addr: *AddrTLS,
 			Handler: mux,
 		}
+		servers = append(servers, server)
 
-		log.Printf("Starting HTTPS server on %q", *AddrTLS)
+		logger.Info("starting HTTPS server", "addr", *AddrTLS)
 		go func() {
-			log.Fatal(server.ListenAndServeTLS(*CertFile, *KeyFile))
+			if err := server.ListenAndServeTLS(*CertFile, *KeyFile); err != http.ErrServerClosed {
+				fatal("HTTPS server failed", err)
+			}
 		}()
 	}
 
-	// Wait forever.
-	select {}
+	// Serve metrics to anyone who can reach the metrics listener, which
+	// would normally be bound to a private interface.
+	if len(*MetricsAddr) > 0 {
+		server := &http.Server{
+			Addr: *MetricsAddr,
+			Handler: metricsRegistry.Handler(),
+		}
+		servers = append(servers, server)
+
+		logger.Info("starting metrics server", "addr", *MetricsAddr)
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("metrics server failed", err)
+			}
+		}()
+	}
+
+	// Run until told to stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	logger.Info("received signal", "signal", (<-signals).String())
+
+	Shutdown(servers, ShutdownTimeout)
+	logger.Info("shutdown complete")
+}
+
+func newSiteMailer() (mailer.Mailer, error) {
+	switch {
+	case *Mailer == "":
+		// only needed to verify email addresses
+		return nil, nil
+	case *Mailer == "smtp":
+		return mailer.NewSMTPMailer(*SMTPAddr, *MailFrom, *SMTPUsername, *SMTPPassword), nil
+	case *Mailer == "log":
+		return mailer.NewLogMailer(), nil
+	case strings.HasPrefix(*Mailer, "file:"):
+		return mailer.NewFileMailer(strings.TrimPrefix(*Mailer, "file:"))
+	default:
+		return nil, fmt.Errorf("unknown mailer '%s'", *Mailer)
+	}
+}
+
+// The database to open: -dsn when given, otherwise the -dbPath SQLite file.
+func databaseDSN() string {
+    if *DSN != "" {
+        return *DSN
+    }
+    return *DbPath
+}
+
+// The database DSN with any password removed, for logging.
+func redactedDSN() string {
+    dsn := databaseDSN()
+    if u, err := url.Parse(dsn); err == nil && u.User != nil {
+        return u.Redacted()
+    }
+    return dsn
+}
+
+// Report the pending schema migrations, trying them without committing
+// them, and exit.
+func migrateDryRun() {
+    if err := persist.Open(databaseDSN()); err != nil {
+        fatal("unable to open database", err)
+    }
+
+    pending, err := persist.Migrate(true)
+    for _, migration := range pending {
+        logger.Info("pending migration", "version", migration.Version, "name", migration.Name)
+    }
+    if err != nil {
+        fatal("migration failed", err)
+    }
+
+    logger.Info("migration dry run complete", "pending", len(pending))
+    os.Exit(0)
+}
+
+func newServeMux() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/api/", func (w http.ResponseWriter, req *http.Request) {
+		pathParams := strings.Split(req.URL.Path, "/")
+		apiResourceHandler(w, req, bearerToken(req), pathParams[2:])
+	})
+	mux.HandleFunc("/api/client/", func (w http.ResponseWriter, req *http.Request) {
+		if !*LegacyKeyPaths {
+			w.WriteHeader(404)
+
+			return
+		}
+
+		pathParams := strings.Split(req.URL.Path, "/")
+		if len(pathParams) >= 5 {
+			apiResourceHandler(w, req, pathParams[3], pathParams[4:])
+		} else {
+			w.WriteHeader(404)
+		}
+	})
+	mux.HandleFunc("/api/client", apiClientHandler)
+	mux.HandleFunc("/api/admin/", adminHandler)
+	staticHandler = newStaticHandler()
+	mux.HandleFunc("/", mainHandler)
+
+	return traceHandler(requestIDHandler(instrumentHandler(mux)))
+}
+
+// Dispatch a request for one of a client's resources. pathParams holds the
+// resource type followed by the resource identifier, which may itself
+// contain slashes.
+func apiResourceHandler(w http.ResponseWriter, req *http.Request, apiKey string, pathParams []string) {
+	if len(pathParams) >= 2 && pathParams[0] == "mutex" {
+		apiMutexHandler(w, req, apiKey, strings.Join(pathParams[1:], "/"))
+	} else if len(pathParams) >= 2 && pathParams[0] == "ratelimit" {
+		apiRateLimitHandler(w, req, apiKey, strings.Join(pathParams[1:], "/"))
+	} else if len(pathParams) >= 1 && pathParams[0] == "keys" {
+		apiKeysHandler(w, req, apiKey, strings.Join(pathParams[1:], "/"))
+	} else if len(pathParams) >= 1 && pathParams[0] == "namespaces" {
+		apiNamespacesHandler(w, req, apiKey, strings.Join(pathParams[1:], "/"))
+	} else if len(pathParams) == 1 && pathParams[0] == "audit" {
+		apiAuditHandler(w, req, apiKey)
+	} else if len(pathParams) == 1 && pathParams[0] == "stats" {
+		apiStatsHandler(w, req, apiKey)
+	} else if len(pathParams) == 1 && pathParams[0] == "dashboard" {
+		apiDashboardHandler(w, req, apiKey)
+	} else {
+		w.WriteHeader(404)
+	}
 }
 
 var readmeHTML []byte
+var staticHandler http.Handler
 
+// Render the README at the root and serve static files (see
+// newStaticHandler) everywhere else.
 func mainHandler(w http.ResponseWriter, req *http.Request) {
+    if req.URL.Path != "/" {
+        staticHandler.ServeHTTP(w, req)
+
+        return
+    }
+
     if len(readmeHTML) == 0 {
         readmeData, _ := ioutil.ReadFile("../README.md")
 
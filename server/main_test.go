@@ -1,29 +1,66 @@
 package main
 
 import (
+    "os"
+    "context"
+    "errors"
+    "bytes"
+    "regexp"
     "fmt"
     "testing"
     "net/http"
+    "net/http/httptest"
     "io/ioutil"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
     "log"
     "encoding/json"
+
+    "mutex/server/logging"
+    "mutex/server/mailer"
+    "mutex/server/persist"
+    "mutex/server/ratelimit"
+    "mutex/server/tracing"
 )
 
 var baseURL string
 var testEmail string
 var clientID string
+var mailBuffer bytes.Buffer
+var verificationLink = regexp.MustCompile(`http://\S+\?verify&token=\S+`)
+
+// Run the tests against an in-process server backed by a scratch database.
+func TestMain(m *testing.M) {
+    dbDir, err := ioutil.TempDir("", "mutex-test")
+    if err != nil {
+        log.Fatal(err)
+    }
 
-func init() {
-    if *AddrTLS != "" {
-        baseURL = "https://" + *AddrTLS
-    } else {
-        baseURL = "http://" + *Addr
+    if err = persist.Init(filepath.Join(dbDir, "mutex_test.db")); err != nil {
+        log.Fatal(err)
     }
 
+    siteMailer = mailer.NewWriterMailer(&mailBuffer)
+    *RequireEmailVerification = true
+
+    server := httptest.NewServer(newServeMux())
+    baseURL = server.URL
+    *BaseURL = server.URL
+    // tests register more clients than the default limit allows
+    *RegistrationsPerHour = 0
+
     testEmail = fmt.Sprintf("test-%d@mutex.us", time.Now().Unix())
 
     log.Printf("mutex.us unit test initialized")
+
+    code := m.Run()
+
+    server.Close()
+    os.RemoveAll(dbDir)
+    os.Exit(code)
 }
 
 func TestRegister(t *testing.T) {
@@ -36,13 +73,22 @@ func TestRegister(t *testing.T) {
                 res.StatusCode, body)
     }
 
+    invalidURL := fmt.Sprintf("%s/api/client?register&email=not-an-email", baseURL)
+    res, _ = http.PostForm(invalidURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 400 {
+        t.Errorf("POST %s: expected 400: received: %d\n%s", invalidURL,
+                res.StatusCode, body)
+    }
+
     registerURL := fmt.Sprintf("%s/api/client?register&email=%s", baseURL, testEmail)
     res, _ = http.PostForm(registerURL, nil)
 
     body, _ = ioutil.ReadAll(res.Body)
-    if res.StatusCode != 200 {
+    if res.StatusCode != 202 {
         bodyText := string(body)
-        t.Errorf("POST %s: expected 200: received: %d\n%s", clientURL,
+        t.Errorf("POST %s: expected 202: received: %d\n%s", clientURL,
                 res.StatusCode, bodyText)
         return
     }
@@ -55,6 +101,33 @@ func TestRegister(t *testing.T) {
         return
     }
 
+    // the key can't be used until the email address is verified
+    keysURL := fmt.Sprintf("%s/api/client/%s/keys", baseURL, clientInfo.ClientID)
+    res, _ = http.Get(keysURL)
+    if res.StatusCode != 401 {
+        t.Errorf("GET %s: expected 401 before verification: received: %d", keysURL,
+                res.StatusCode)
+    }
+
+    verifyURL := verificationLink.FindString(mailBuffer.String())
+    if verifyURL == "" {
+        t.Fatalf("TestRegister: no verification link mailed:\n%s", mailBuffer.String())
+    }
+
+    res, _ = http.Get(verifyURL)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Errorf("GET %s: expected 200: received: %d\n%s", verifyURL,
+                res.StatusCode, body)
+    }
+
+    res, _ = http.Get(verifyURL)
+    if res.StatusCode != 400 {
+        t.Errorf("GET %s: expected 400 verifying twice: received: %d", verifyURL,
+                res.StatusCode)
+    }
+
     clientID = clientInfo.ClientID
 }
 
@@ -72,6 +145,9 @@ func TestLock(t *testing.T) {
                 res.StatusCode, bodyText)
     }
 
+    var lock HttpLockSuccess
+    json.Unmarshal(body, &lock)
+
     res, _ = http.PostForm(lockURL, nil)
 
     body, _ = ioutil.ReadAll(res.Body)
@@ -80,7 +156,16 @@ func TestLock(t *testing.T) {
                 res.StatusCode, bodyText)
     }
 
-    unlockURL := fmt.Sprintf("%s?unlock", mutexURL)
+    // the lock's token is required
+    res, _ = http.PostForm(mutexURL + "?unlock", nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 400 {
+        t.Errorf("POST %s?unlock without token: expected 400: received: %d\n%s", mutexURL,
+                res.StatusCode, body)
+    }
+
+    unlockURL := fmt.Sprintf("%s?unlock&token=%d", mutexURL, lock.Token)
     res, _ = http.PostForm(unlockURL, nil)
 
     body, _ = ioutil.ReadAll(res.Body)
@@ -99,3 +184,1505 @@ func TestLock(t *testing.T) {
                 res.StatusCode, bodyText)
     }
 }
+
+func TestRateLimit(t *testing.T) {
+    limiterURL := fmt.Sprintf("%s/api/client/%s/ratelimit/partner-quota", baseURL,
+            clientID)
+
+    takeURL := fmt.Sprintf("%s?take&n=1", limiterURL)
+    res, _ := http.PostForm(takeURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 400 {
+        t.Errorf("POST %s: expected 400: received: %d\n%s", takeURL,
+                res.StatusCode, body)
+    }
+
+    createURL := fmt.Sprintf("%s?take&n=1&rate=2&interval=1m&burst=2", limiterURL)
+    for i := 0; i < 2; i++ {
+        res, _ = http.PostForm(createURL, nil)
+
+        body, _ = ioutil.ReadAll(res.Body)
+        if res.StatusCode != 200 {
+            t.Errorf("POST %s: expected 200: received: %d\n%s", createURL,
+                    res.StatusCode, body)
+        }
+    }
+
+    res, _ = http.PostForm(takeURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 429 || res.Header.Get("Retry-After") == "" {
+        t.Errorf("POST %s: expected 429 with Retry-After: received: %d\n%s", takeURL,
+                res.StatusCode, body)
+    }
+}
+
+// burst defaults to rate, not to the rate per second.
+func TestRateLimitDefaultBurst(t *testing.T) {
+    takeURL := fmt.Sprintf("%s/api/client/%s/ratelimit/partner-api?take&rate=100&interval=1m&n=50",
+            baseURL, clientID)
+    for i := 0; i < 2; i++ {
+        res, _ := http.PostForm(takeURL, nil)
+
+        body, _ := ioutil.ReadAll(res.Body)
+        if res.StatusCode != 200 {
+            t.Errorf("POST %s: expected 200: received: %d\n%s", takeURL,
+                    res.StatusCode, body)
+        }
+    }
+
+    res, _ := http.PostForm(takeURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 429 {
+        t.Errorf("POST %s with the burst taken: expected 429: received: %d\n%s", takeURL,
+                res.StatusCode, body)
+    }
+}
+
+func TestPlanQuotas(t *testing.T) {
+    persist.Insert(&Plan{
+        Name: "test-tiny",
+        MaxWaitMs: 1000,
+        MaxLeaseMs: 100,
+        MaxMutexes: 1,
+        MaxWaiters: 1,
+        MaxRequestsPerMinute: 60,
+    })
+
+    tinyClient := &ClientInfo{
+        Email: fmt.Sprintf("tiny-%d@mutex.us", time.Now().Unix()),
+        ClientID: fmt.Sprintf("tiny-%d", time.Now().UnixNano()),
+        Plan: "test-tiny",
+    }
+    if err := persist.Insert(tinyClient); err != nil {
+        t.Fatalf("TestPlanQuotas: unable to insert client: %v", err)
+    }
+
+    // clients inserted with a plaintext key are migrated to a hashed one
+    ctx := context.Background()
+    if err := persist.WithTx(ctx, func (tx persist.Records) error {
+        return migratePlaintextKeys(ctx, tx)
+    }); err != nil {
+        t.Fatalf("TestPlanQuotas: unable to migrate keys: %v", err)
+    }
+
+    if clientInfo, err := FindClient(tinyClient.Email); err != nil || clientInfo.ClientID != "" {
+        t.Errorf("TestPlanQuotas: plaintext key still stored after migration")
+    }
+
+    clientURL := fmt.Sprintf("%s/api/client/%s", baseURL, tinyClient.ClientID)
+
+    lockURL := fmt.Sprintf("%s/mutex/first?lock&waitTimeoutMs=0", clientURL)
+    res, _ := http.PostForm(lockURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d\n%s", lockURL,
+                res.StatusCode, body)
+    }
+
+    takeURL := fmt.Sprintf("%s/ratelimit/tiny?take&rate=1&interval=1h", clientURL)
+    res, _ = http.PostForm(takeURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d\n%s", takeURL,
+                res.StatusCode, body)
+    }
+
+    // a negative wait timeout mustn't wait past the plan's maximum wait for
+    // the held mutex or the empty rate limiter
+    for _, waitURL := range []string{
+        fmt.Sprintf("%s/mutex/first?lock&waitTimeoutMs=-1", clientURL),
+        fmt.Sprintf("%s/ratelimit/tiny?take&waitTimeoutMs=-1", clientURL),
+    } {
+        start := time.Now()
+        res, _ = http.PostForm(waitURL, nil)
+
+        body, _ = ioutil.ReadAll(res.Body)
+        if res.StatusCode != 400 || time.Since(start) >= time.Second {
+            t.Errorf("POST %s: expected 400 within the plan's maximum wait: received: %d after %v\n%s",
+                    waitURL, res.StatusCode, time.Since(start), body)
+        }
+    }
+
+    secondURL := fmt.Sprintf("%s/mutex/second?lock&waitTimeoutMs=0", clientURL)
+    res, _ = http.PostForm(secondURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 429 {
+        t.Errorf("POST %s: expected 429: received: %d\n%s", secondURL,
+                res.StatusCode, body)
+    }
+
+    // the plan's lease releases the first mutex automatically
+    time.Sleep(200 * time.Millisecond)
+
+    res, _ = http.PostForm(secondURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200 after lease expiry: received: %d\n%s", secondURL,
+                res.StatusCode, body)
+    }
+}
+
+func TestApiKeys(t *testing.T) {
+    keysURL := fmt.Sprintf("%s/api/client/%s/keys", baseURL, clientID)
+
+    createURL := fmt.Sprintf("%s?create&name=ci", keysURL)
+    res, _ := http.PostForm(createURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", createURL,
+                res.StatusCode, body)
+    }
+
+    var ciKey ApiKey
+    if err := json.Unmarshal(body, &ciKey); err != nil || ciKey.Key == "" {
+        t.Fatalf("TestApiKeys: unable to unmarshal ApiKey")
+    }
+
+    rotateURL := fmt.Sprintf("%s/ci?rotate", keysURL)
+    res, _ = http.PostForm(rotateURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", rotateURL,
+                res.StatusCode, body)
+    }
+
+    var rotatedKey ApiKey
+    json.Unmarshal(body, &rotatedKey)
+
+    oldKeyURL := fmt.Sprintf("%s/api/client/%s/keys", baseURL, ciKey.Key)
+    res, _ = http.Get(oldKeyURL)
+    if res.StatusCode != 401 {
+        t.Errorf("GET %s: expected 401 for rotated key: received: %d", oldKeyURL,
+                res.StatusCode)
+    }
+
+    // the rotated key belongs to the same account and can manage its keys
+    revokeURL := fmt.Sprintf("%s/api/client/%s/keys/primary?revoke", baseURL, rotatedKey.Key)
+    res, _ = http.PostForm(revokeURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d\n%s", revokeURL,
+                res.StatusCode, body)
+    }
+
+    lastURL := fmt.Sprintf("%s/api/client/%s/keys/ci?revoke", baseURL, rotatedKey.Key)
+    res, _ = http.PostForm(lastURL, nil)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 400 {
+        t.Errorf("POST %s: expected 400 revoking last key: received: %d\n%s", lastURL,
+                res.StatusCode, body)
+    }
+
+    clientID = rotatedKey.Key
+}
+
+// Only one of several concurrent requests to create a key of the same name
+// succeeds.
+func TestConcurrentKeyCreate(t *testing.T) {
+    createURL := fmt.Sprintf("%s/api/client/%s/keys?create&name=concurrent", baseURL, clientID)
+
+    var wg sync.WaitGroup
+    statuses := make(chan int, 5)
+    for i := 0; i < 5; i++ {
+        wg.Add(1)
+        go func () {
+            defer wg.Done()
+
+            res, err := http.PostForm(createURL, nil)
+            if err != nil {
+                statuses <- 0
+
+                return
+            }
+            ioutil.ReadAll(res.Body)
+            statuses <- res.StatusCode
+        }()
+    }
+    wg.Wait()
+    close(statuses)
+
+    created := 0
+    for status := range statuses {
+        if status == 200 {
+            created++
+        }
+    }
+
+    if created != 1 {
+        t.Errorf("POST %s concurrently: expected one key created: created %d", createURL, created)
+    }
+}
+
+// A store that can't read key revocations.
+type revocationErrorStore struct {
+    persist.Store
+}
+
+func (s revocationErrorStore) Find(ctx context.Context, r interface{}) error {
+    if _, ok := r.(*KeyRevocation); ok {
+        return errors.New("database unavailable")
+    }
+
+    return s.Store.Find(ctx, r)
+}
+
+// A key whose revocation can't be checked mustn't be accepted.
+func TestKeyRevocationError(t *testing.T) {
+    key := registerTestClient(t, fmt.Sprintf("revocation-%d@mutex.us", time.Now().Unix()))
+    lockURL := fmt.Sprintf("%s/api/mutex/revocation-error?lock&waitTimeoutMs=0", baseURL)
+
+    persist.Use(revocationErrorStore{persist.Current()})
+    res := postWithKey(key, lockURL)
+    persist.Use(persist.Current().(revocationErrorStore).Store)
+
+    if res.StatusCode != 401 {
+        t.Errorf("POST %s while revocations can't be read: expected 401: received: %d", lockURL,
+                res.StatusCode)
+    }
+
+    if res = postWithKey(key, lockURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", lockURL, res.StatusCode)
+    }
+}
+
+func TestBearerAuth(t *testing.T) {
+    lockURL := fmt.Sprintf("%s/api/mutex/bearer/mutex?lock&waitTimeoutMs=0", baseURL)
+
+    res, _ := http.PostForm(lockURL, nil)
+    if res.StatusCode != 401 {
+        t.Errorf("POST %s without key: expected 401: received: %d", lockURL,
+                res.StatusCode)
+    }
+
+    req, _ := http.NewRequest("POST", lockURL, nil)
+    req.Header.Set("Authorization", "Bearer not-a-valid-api-key")
+    res, _ = http.DefaultClient.Do(req)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 401 || strings.Contains(string(body), "not-a-valid-api-key") {
+        t.Errorf("POST %s with invalid key: expected redacted 401: received: %d\n%s", lockURL,
+                res.StatusCode, body)
+    }
+
+    opURL := fmt.Sprintf("%s/api/mutex/bearer/mutex?lock&waitTimeoutMs=0", baseURL)
+    res, token := lockWithKey(clientID, opURL)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", opURL, res.StatusCode)
+    }
+
+    opURL = fmt.Sprintf("%s/api/mutex/bearer/mutex?unlock&token=%d", baseURL, token)
+    if res = postWithKey(clientID, opURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", opURL, res.StatusCode)
+    }
+}
+
+func TestScopedKeys(t *testing.T) {
+    createURL := fmt.Sprintf("%s/api/client/%s/keys?create&name=vendor&scope=billing/*&operations=status,lock&expiresIn=24h",
+            baseURL, clientID)
+    res, _ := http.PostForm(createURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", createURL,
+                res.StatusCode, body)
+    }
+
+    var vendorKey ApiKey
+    json.Unmarshal(body, &vendorKey)
+
+    expected := []struct {
+        path string
+        statusCode int
+    }{
+        {"mutex/billing/42?lock&waitTimeoutMs=0", 200},
+        {"mutex/billing/42?unlock&token={token}", 200},
+        {"mutex/billing/42?status", 200},
+        {"mutex/shipping/42?lock&waitTimeoutMs=0", 403},
+        {"ratelimit/billing/api?take&rate=1", 403},
+        {"keys?create&name=escalated", 403},
+    }
+
+    // the token of the last lock, for unlocking it
+    var lock HttpLockSuccess
+    for _, op := range expected {
+        path := strings.Replace(op.path, "{token}", fmt.Sprint(lock.Token), 1)
+        statusCode := op.statusCode
+        opURL := fmt.Sprintf("%s/api/%s", baseURL, path)
+        req, _ := http.NewRequest("POST", opURL, nil)
+        req.Header.Set("Authorization", "Bearer " + vendorKey.Key)
+        res, _ = http.DefaultClient.Do(req)
+
+        body, _ = ioutil.ReadAll(res.Body)
+        if res.StatusCode != statusCode {
+            t.Errorf("POST %s: expected %d: received: %d\n%s", opURL, statusCode,
+                    res.StatusCode, body)
+        }
+
+        if strings.Contains(path, "?lock") && res.StatusCode == 200 {
+            json.Unmarshal(body, &lock)
+        }
+    }
+}
+
+func TestCredentialExpiry(t *testing.T) {
+    credential := &Credential{
+        Account: testEmail,
+        Scope: &KeyScope{
+            Expires: time.Now().Add(-time.Second).Unix(),
+        },
+    }
+
+    if !credential.expired() {
+        t.Errorf("TestCredentialExpiry: credential past its expiry not expired")
+    }
+
+    credential.Scope.Expires = time.Now().Add(time.Hour).Unix()
+    if credential.expired() {
+        t.Errorf("TestCredentialExpiry: unexpired credential expired")
+    }
+}
+
+// Register and verify a client, returning its API key.
+func registerTestClient(t *testing.T, email string) string {
+    registerURL := fmt.Sprintf("%s/api/client?register&email=%s", baseURL, email)
+    res, _ := http.PostForm(registerURL, nil)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    var clientInfo ClientInfo
+    if err := json.Unmarshal(body, &clientInfo); err != nil || clientInfo.ClientID == "" {
+        t.Fatalf("POST %s: unable to register: %d\n%s", registerURL, res.StatusCode, body)
+    }
+
+    verifyURLs := verificationLink.FindAllString(mailBuffer.String(), -1)
+    res, _ = http.Get(verifyURLs[len(verifyURLs)-1])
+    if res.StatusCode != 200 {
+        t.Fatalf("TestRegister: unable to verify %s: %d", email, res.StatusCode)
+    }
+
+    return clientInfo.ClientID
+}
+
+func postWithKey(apiKey string, url string) *http.Response {
+    req, _ := http.NewRequest("POST", url, nil)
+    req.Header.Set("Authorization", "Bearer " + apiKey)
+    res, _ := http.DefaultClient.Do(req)
+    ioutil.ReadAll(res.Body)
+
+    return res
+}
+
+// Lock a mutex, returning the response and the lock's token.
+func lockWithKey(apiKey string, url string) (*http.Response, uint64) {
+    req, _ := http.NewRequest("POST", url, nil)
+    req.Header.Set("Authorization", "Bearer " + apiKey)
+    res, _ := http.DefaultClient.Do(req)
+    body, _ := ioutil.ReadAll(res.Body)
+
+    var lock HttpLockSuccess
+    json.Unmarshal(body, &lock)
+
+    return res, lock.Token
+}
+
+func TestNamespaces(t *testing.T) {
+    otherEmail := fmt.Sprintf("other-%d@mutex.us", time.Now().Unix())
+    otherKey := registerTestClient(t, otherEmail)
+
+    namespaceURL := fmt.Sprintf("%s/api/namespaces/team-sync", baseURL)
+    if res := postWithKey(clientID, namespaceURL + "?create"); res.StatusCode != 200 {
+        t.Fatalf("POST %s?create: expected 200: received: %d", namespaceURL, res.StatusCode)
+    }
+
+    lockURL := fmt.Sprintf("%s/api/mutex/0031D00000jU1OyQAK?lock&waitTimeoutMs=0&namespace=team-sync", baseURL)
+    unlockURL := fmt.Sprintf("%s/api/mutex/0031D00000jU1OyQAK?unlock&namespace=team-sync&token=", baseURL)
+
+    if res := postWithKey(otherKey, lockURL); res.StatusCode != 403 {
+        t.Errorf("POST %s before grant: expected 403: received: %d", lockURL, res.StatusCode)
+    }
+
+    grantURL := fmt.Sprintf("%s?grant&email=%s", namespaceURL, otherEmail)
+    if res := postWithKey(otherKey, grantURL); res.StatusCode != 403 {
+        t.Errorf("POST %s by non-owner: expected 403: received: %d", grantURL, res.StatusCode)
+    }
+
+    if res := postWithKey(clientID, grantURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d", grantURL, res.StatusCode)
+    }
+
+    // both accounts now contend on the same mutex
+    res, token := lockWithKey(clientID, lockURL)
+    if res.StatusCode != 200 {
+        t.Errorf("POST %s by owner: expected 200: received: %d", lockURL, res.StatusCode)
+    }
+
+    if res := postWithKey(otherKey, lockURL); res.StatusCode != 409 {
+        t.Errorf("POST %s while held: expected 409: received: %d", lockURL, res.StatusCode)
+    }
+
+    if res := postWithKey(clientID, unlockURL + fmt.Sprint(token)); res.StatusCode != 200 {
+        t.Errorf("POST %s%d: expected 200: received: %d", unlockURL, token, res.StatusCode)
+    }
+
+    if res, token = lockWithKey(otherKey, lockURL); res.StatusCode != 200 {
+        t.Errorf("POST %s after unlock: expected 200: received: %d", lockURL, res.StatusCode)
+    }
+
+    for _, emptyURL := range []string{namespaceURL + "?grant&email=", namespaceURL + "?revoke&email="} {
+        if res := postWithKey(clientID, emptyURL); res.StatusCode != 400 {
+            t.Errorf("POST %s: expected 400: received: %d", emptyURL, res.StatusCode)
+        }
+    }
+
+    if _, err := FindClient(""); !errors.Is(err, persist.ErrNotFound) {
+        t.Errorf("FindClient(\"\"): expected ErrNotFound: received: %v", err)
+    }
+
+    if _, err := resourcesAccount(namespaceResources("no-such-namespace")); err == nil {
+        t.Errorf("resourcesAccount of a missing namespace: expected an error")
+    }
+
+    // an empty revoke didn't revoke the grant
+    if res := postWithKey(otherKey, lockURL); res.StatusCode != 409 {
+        t.Errorf("POST %s while held by the grantee: expected 409: received: %d", lockURL, res.StatusCode)
+    }
+
+    revokeURL := fmt.Sprintf("%s?revoke&email=%s", namespaceURL, otherEmail)
+    if res := postWithKey(clientID, revokeURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", revokeURL, res.StatusCode)
+    }
+
+    if res := postWithKey(otherKey, unlockURL + fmt.Sprint(token)); res.StatusCode != 403 {
+        t.Errorf("POST %s%d after revoke: expected 403: received: %d", unlockURL, token, res.StatusCode)
+    }
+}
+
+func TestMetrics(t *testing.T) {
+    metricsURL := fmt.Sprintf("%s/metrics", baseURL)
+    res, _ := http.Get(metricsURL)
+    if res.StatusCode != 401 {
+        t.Errorf("GET %s without admin credential: expected 401: received: %d", metricsURL,
+                res.StatusCode)
+    }
+
+    req, _ := http.NewRequest("GET", metricsURL, nil)
+    req.Header.Set("Authorization", "Bearer " + *AdminID)
+    res, _ = http.DefaultClient.Do(req)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    if res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected 200: received: %d\n%s", metricsURL, res.StatusCode, body)
+    }
+
+    for _, expected := range []string{
+        "mutex_lock_acquisitions_total ",
+        "mutex_lock_timeouts_total ",
+        "mutex_locks_held ",
+        `mutex_http_request_duration_seconds_count{route="/api/mutex",code="200"}`,
+    } {
+        if !strings.Contains(string(body), expected) {
+            t.Errorf("GET %s: missing %q", metricsURL, expected)
+        }
+    }
+
+    if strings.Contains(string(body), clientID) {
+        t.Errorf("GET %s: metrics contain an API key", metricsURL)
+    }
+
+    statsURL := fmt.Sprintf("%s/stats", baseURL)
+    req, _ = http.NewRequest("GET", statsURL, nil)
+    req.Header.Set("Authorization", "Bearer " + *AdminID)
+    res, _ = http.DefaultClient.Do(req)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    var stats HttpStats
+    if err := json.Unmarshal(body, &stats); err != nil || stats.TotalLocks == 0 {
+        t.Errorf("GET %s: expected valid stats: received: %d\n%s", statsURL, res.StatusCode, body)
+    }
+}
+
+// A buffer that may be written by server goroutines while a test reads it.
+type syncBuffer struct {
+    mu sync.Mutex
+    buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return b.buffer.String()
+}
+
+func TestLogPath(t *testing.T) {
+    key := "0d9a60f1-0120-40f3-bee4-55cc86f5cf7f"
+    for _, path := range []string{
+        "/api/client/" + key,
+        "/api/client/" + key + "/",
+        "/api/client/" + key + "/mutex/first",
+    } {
+        if logged := logPath(path); strings.Contains(logged, key) || !strings.HasPrefix(logged, "/api/client/0d9a60f1") {
+            t.Errorf("logPath(%q): expected the key redacted: received %q", path, logged)
+        }
+    }
+}
+
+func TestRequestIDs(t *testing.T) {
+    var logBuffer syncBuffer
+    savedLogger := logger
+    logger = logging.New(&logBuffer, logging.Debug)
+    defer func () { logger = savedLogger }()
+
+    lockURL := fmt.Sprintf("%s/api/mutex/request-id-test?lock&waitTimeoutMs=0", baseURL)
+    unlockURL := fmt.Sprintf("%s/api/mutex/request-id-test?unlock", baseURL)
+
+    var lock HttpLockSuccess
+    lockWithID := func (requestID string) *http.Response {
+        req, _ := http.NewRequest("POST", lockURL, nil)
+        req.Header.Set("Authorization", "Bearer " + clientID)
+        req.Header.Set("X-Request-Id", requestID)
+        res, _ := http.DefaultClient.Do(req)
+        body, _ := ioutil.ReadAll(res.Body)
+        if res.StatusCode == 200 {
+            json.Unmarshal(body, &lock)
+        }
+
+        return res
+    }
+
+    if res := lockWithID("holder-1"); res.StatusCode != 200 || res.Header.Get("X-Request-Id") != "holder-1" {
+        t.Fatalf("POST %s: expected 200 with request ID holder-1: received: %d %q", lockURL,
+                res.StatusCode, res.Header.Get("X-Request-Id"))
+    }
+
+    if res := lockWithID("waiter-2"); res.StatusCode != 409 {
+        t.Errorf("POST %s while held: expected 409: received: %d", lockURL, res.StatusCode)
+    }
+
+    // the failed lock's log entry names the request holding the mutex
+    found := false
+    for _, line := range strings.Split(logBuffer.String(), "\n") {
+        var entry map[string]interface{}
+        if json.Unmarshal([]byte(line), &entry) != nil {
+            continue
+        }
+
+        if entry["msg"] == "lock failed" && entry["request_id"] == "waiter-2" &&
+                entry["holder_request_id"] == "holder-1" {
+            found = true
+        }
+    }
+    if !found {
+        t.Errorf("no log entry correlating waiter-2 with holder-1:\n%s", logBuffer.String())
+    }
+
+    // unusable request IDs are replaced
+    if res := lockWithID("bad id {}"); res.Header.Get("X-Request-Id") == "" ||
+            strings.Contains(res.Header.Get("X-Request-Id"), " ") {
+        t.Errorf("POST %s with invalid request ID: received %q", lockURL, res.Header.Get("X-Request-Id"))
+    }
+
+    postWithKey(clientID, fmt.Sprintf("%s&token=%d", unlockURL, lock.Token))
+}
+
+func TestTracing(t *testing.T) {
+    var collectorMutex sync.Mutex
+    spans := map[string]map[string]interface{}{}
+    collector := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
+        var request struct {
+            ResourceSpans []struct {
+                ScopeSpans []struct {
+                    Spans []map[string]interface{} `json:"spans"`
+                } `json:"scopeSpans"`
+            } `json:"resourceSpans"`
+        }
+        json.NewDecoder(req.Body).Decode(&request)
+
+        collectorMutex.Lock()
+        defer collectorMutex.Unlock()
+        for _, resourceSpans := range request.ResourceSpans {
+            for _, scopeSpans := range resourceSpans.ScopeSpans {
+                for _, span := range scopeSpans.Spans {
+                    spans[span["name"].(string)] = span
+                }
+            }
+        }
+    }))
+    defer collector.Close()
+
+    tracer = tracing.NewTracer("mutex", tracing.NewExporter(collector.URL, 1000, time.Hour))
+    defer func () { tracer = nil }()
+
+    traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+    var lock HttpLockSuccess
+    for _, operation := range []string{"lock", "unlock&token="} {
+        url := fmt.Sprintf("%s/api/mutex/trace-test?%s", baseURL, operation)
+        if lock.Token != 0 {
+            url += fmt.Sprint(lock.Token)
+        }
+        req, _ := http.NewRequest("POST", url, nil)
+        req.Header.Set("Authorization", "Bearer " + clientID)
+        req.Header.Set("traceparent", "00-" + traceID + "-00f067aa0ba902b7-01")
+        res, _ := http.DefaultClient.Do(req)
+        body, _ := ioutil.ReadAll(res.Body)
+
+        if res.StatusCode != 200 {
+            t.Fatalf("POST %s: expected 200: received: %d", url, res.StatusCode)
+        }
+        json.Unmarshal(body, &lock)
+    }
+
+    if err := tracer.Flush(); err != nil {
+        t.Fatalf("Flush: %v", err)
+    }
+
+    collectorMutex.Lock()
+    defer collectorMutex.Unlock()
+
+    for _, name := range []string{"POST /api/mutex", "verify client", "mutex wait", "mutex hold"} {
+        span, ok := spans[name]
+        if !ok {
+            t.Errorf("span %q was not exported", name)
+        } else if span["traceId"] != traceID {
+            t.Errorf("span %q is not part of the caller's trace: %v", name, span)
+        }
+    }
+}
+
+func TestAudit(t *testing.T) {
+    start := time.Now().UnixMilli()
+    mutexURL := fmt.Sprintf("%s/api/mutex/audit-test", baseURL)
+
+    _, token := lockWithKey(clientID, mutexURL + "?lock")
+    postWithKey(clientID, fmt.Sprintf("%s?unlock&token=%d", mutexURL, token))
+
+    // the renewed lease outlasts the one the mutex was locked with
+    _, token = lockWithKey(clientID, mutexURL + "?lock&leaseMs=50")
+    renewURL := fmt.Sprintf("%s?renew&token=%d&leaseMs=200", mutexURL, token)
+    if res := postWithKey(clientID, renewURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", renewURL, res.StatusCode)
+    }
+    time.Sleep(100 * time.Millisecond)
+    if locked, _ := GetMutexStatus(testEmail, "audit-test"); !locked {
+        t.Errorf("POST %s: mutex released when its original lease expired", renewURL)
+    }
+    time.Sleep(300 * time.Millisecond)
+
+    if res := postWithKey(clientID, renewURL); res.StatusCode != 409 {
+        t.Errorf("POST %s after the lease expired: expected 409: received: %d", renewURL, res.StatusCode)
+    }
+
+    auditURL := fmt.Sprintf("%s/api/audit?mutex=audit-test&since=%d", baseURL, start)
+    req, _ := http.NewRequest("GET", auditURL, nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ := http.DefaultClient.Do(req)
+
+    body, _ := ioutil.ReadAll(res.Body)
+    var events []AuditEvent
+    if err := json.Unmarshal(body, &events); err != nil || res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected 200: received: %d\n%s", auditURL, res.StatusCode, body)
+    }
+
+    actions := []string{}
+    for _, event := range events {
+        actions = append(actions, event.Action)
+    }
+
+    // newest first
+    expected := []string{AuditRenew, AuditExpire, AuditRenew, AuditLock, AuditUnlock, AuditLock}
+    if strings.Join(actions, ",") != strings.Join(expected, ",") {
+        t.Fatalf("GET %s: expected actions %v: received %v", auditURL, expected, actions)
+    }
+
+    if events[5].Holder == 0 || events[4].Holder != events[5].Holder || events[1].Holder != events[3].Holder ||
+            events[2].Holder != events[3].Holder {
+        t.Errorf("GET %s: holder tokens don't match: %s", auditURL, body)
+    }
+
+    if events[5].Client != testEmail || events[5].RemoteAddr == "" || events[5].RequestID == "" ||
+            events[1].Client != "" || events[0].Outcome == "ok" {
+        t.Errorf("GET %s: unexpected event details: %s", auditURL, body)
+    }
+
+    limitURL := fmt.Sprintf("%s/api/audit?mutex=audit-test&limit=1", baseURL)
+    req, _ = http.NewRequest("GET", limitURL, nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ = http.DefaultClient.Do(req)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if err := json.Unmarshal(body, &events); err != nil || len(events) != 1 || events[0].Action != AuditRenew {
+        t.Errorf("GET %s: expected the newest event: received: %s", limitURL, body)
+    }
+
+    // events older than -auditRetention are deleted
+    expired := &AuditEvent{
+        ID: "audit-retention-test",
+        Time: time.Now().Add(-48 * time.Hour).UnixMilli(),
+        Resources: testEmail,
+        Action: AuditLock,
+        Identifier: "audit-test",
+    }
+    if err := persist.Insert(expired); err != nil {
+        t.Fatalf("Insert(expired event): %v", err)
+    }
+
+    savedRetention := AuditRetention
+    AuditRetention = 24 * time.Hour
+    sweepAuditEvents(time.Now())
+    AuditRetention = savedRetention
+
+    if err := persist.Find(&AuditEvent{ID: expired.ID}); !errors.Is(err, persist.ErrNotFound) {
+        t.Errorf("sweepAuditEvents: expired event not deleted: %v", err)
+    }
+    if recent, _ := FindAuditEvents(testEmail, "audit-test", start, maxAuditEvents); len(recent) != len(expected) {
+        t.Errorf("sweepAuditEvents: expected %d recent events to be kept: %d kept", len(expected), len(recent))
+    }
+
+    laterURL := fmt.Sprintf("%s/api/audit?mutex=audit-test&since=%s", baseURL,
+            time.Now().Add(time.Hour).Format(time.RFC3339))
+    req, _ = http.NewRequest("GET", laterURL, nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ = http.DefaultClient.Do(req)
+
+    body, _ = ioutil.ReadAll(res.Body)
+    if strings.TrimSpace(string(body)) != "[]" {
+        t.Errorf("GET %s: expected no events: received %s", laterURL, body)
+    }
+}
+
+func adminRequest(method string, url string) (*http.Response, []byte) {
+    req, _ := http.NewRequest(method, url, nil)
+    req.Header.Set("Authorization", "Bearer " + *AdminID)
+    res, _ := http.DefaultClient.Do(req)
+    body, _ := ioutil.ReadAll(res.Body)
+
+    return res, body
+}
+
+func TestAdmin(t *testing.T) {
+    clientsURL := fmt.Sprintf("%s/api/admin/clients", baseURL)
+
+    // the admin credential is only accepted in a header
+    if res, _ := http.Get(fmt.Sprintf("%s?adminID=%s", clientsURL, *AdminID)); res.StatusCode != 401 {
+        t.Errorf("GET %s with adminID parameter: expected 401: received: %d", clientsURL, res.StatusCode)
+    }
+
+    if res := postWithKey(clientID, clientsURL); res.StatusCode != 401 {
+        t.Errorf("POST %s with client key: expected 401: received: %d", clientsURL, res.StatusCode)
+    }
+
+    res, body := adminRequest("GET", clientsURL)
+    var clients []AdminClientInfo
+    if err := json.Unmarshal(body, &clients); err != nil || res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected 200: received: %d\n%s", clientsURL, res.StatusCode, body)
+    }
+
+    found := false
+    for _, client := range clients {
+        found = found || client.Email == testEmail
+    }
+    if !found {
+        t.Errorf("GET %s: %s not listed\n%s", clientsURL, testEmail, body)
+    }
+
+    // force-release a held mutex: the waiter acquires it and the old
+    // holder's token is no longer valid
+    mutexURL := fmt.Sprintf("%s/api/mutex/admin-test", baseURL)
+    req, _ := http.NewRequest("POST", mutexURL + "?lock", nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ = http.DefaultClient.Do(req)
+    body, _ = ioutil.ReadAll(res.Body)
+
+    var lock HttpLockSuccess
+    if err := json.Unmarshal(body, &lock); err != nil || lock.Token == 0 {
+        t.Fatalf("POST %s?lock: expected a token: received: %d\n%s", mutexURL, res.StatusCode, body)
+    }
+
+    waiter := make(chan uint64)
+    go func () {
+        _, token := lockWithKey(clientID, mutexURL + "?lock&waitTimeoutMs=5000")
+        waiter <- token
+    }()
+
+    mutexesURL := fmt.Sprintf("%s/api/admin/mutexes?client=%s", baseURL, testEmail)
+    for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+        _, body = adminRequest("GET", mutexesURL)
+        if strings.Contains(string(body), `"identifier":"admin-test","locked":true`) &&
+                strings.Contains(string(body), `"waiters":1`) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    releaseURL := fmt.Sprintf("%s/api/admin/mutexes/admin-test?release&client=%s", baseURL, testEmail)
+    if res, body = adminRequest("POST", releaseURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", releaseURL, res.StatusCode, body)
+    }
+
+    token := <-waiter
+    if token == 0 {
+        t.Errorf("POST %s?lock waiting for force-released mutex: expected a token", mutexURL)
+    }
+
+    staleURL := fmt.Sprintf("%s?unlock&token=%d", mutexURL, lock.Token)
+    if res := postWithKey(clientID, staleURL); res.StatusCode != 409 {
+        t.Errorf("POST %s with force-released token: expected 409: received: %d", staleURL, res.StatusCode)
+    }
+
+    unlockURL := fmt.Sprintf("%s?unlock&token=%d", mutexURL, token)
+    if res := postWithKey(clientID, unlockURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d", unlockURL, res.StatusCode)
+    }
+
+    // suspend and resume a client
+    otherEmail := fmt.Sprintf("suspended-%d@mutex.us", time.Now().Unix())
+    otherKey := registerTestClient(t, otherEmail)
+    statusURL := fmt.Sprintf("%s/api/mutex/admin-test?status", baseURL)
+
+    suspendURL := fmt.Sprintf("%s/%s?suspend", clientsURL, otherEmail)
+    if res, body = adminRequest("POST", suspendURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", suspendURL, res.StatusCode, body)
+    }
+
+    req, _ = http.NewRequest("GET", statusURL, nil)
+    req.Header.Set("Authorization", "Bearer " + otherKey)
+    if res, _ = http.DefaultClient.Do(req); res.StatusCode != 403 {
+        t.Errorf("GET %s while suspended: expected 403: received: %d", statusURL, res.StatusCode)
+    }
+
+    resumeURL := fmt.Sprintf("%s/%s?resume", clientsURL, otherEmail)
+    if res, body = adminRequest("POST", resumeURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", resumeURL, res.StatusCode, body)
+    }
+
+    req, _ = http.NewRequest("GET", statusURL, nil)
+    req.Header.Set("Authorization", "Bearer " + otherKey)
+    if res, _ = http.DefaultClient.Do(req); res.StatusCode != 200 {
+        t.Errorf("GET %s after resume: expected 200: received: %d", statusURL, res.StatusCode)
+    }
+
+    purgeURL := fmt.Sprintf("%s/api/admin/purge", baseURL)
+    if res, body = adminRequest("POST", purgeURL); res.StatusCode != 200 {
+        t.Errorf("POST %s: expected 200: received: %d\n%s", purgeURL, res.StatusCode, body)
+    }
+}
+
+// Plans created and assigned through the admin API apply to clients that
+// are already loaded.
+func TestAdminPlans(t *testing.T) {
+    email := fmt.Sprintf("plans-%d@mutex.us", time.Now().Unix())
+    key := registerTestClient(t, email)
+
+    firstURL := fmt.Sprintf("%s/api/mutex/plans-first?lock&waitTimeoutMs=0", baseURL)
+    secondURL := fmt.Sprintf("%s/api/mutex/plans-second?lock&waitTimeoutMs=0", baseURL)
+    if res := postWithKey(key, firstURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d", firstURL, res.StatusCode)
+    }
+
+    savePlan := func (body string) (*http.Response, []byte) {
+        planURL := fmt.Sprintf("%s/api/admin/plans/test-single", baseURL)
+        req, _ := http.NewRequest("POST", planURL, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer " + *AdminID)
+        res, _ := http.DefaultClient.Do(req)
+        resBody, _ := ioutil.ReadAll(res.Body)
+
+        return res, resBody
+    }
+
+    if res, body := savePlan(`{"maxWaitMs":1000,"maxMutexes":-1}`); res.StatusCode != 400 {
+        t.Errorf("POST plan with a negative limit: expected 400: received: %d\n%s", res.StatusCode, body)
+    }
+
+    if res, body := savePlan(`{"maxWaitMs":1000,"maxMutexes":1}`); res.StatusCode != 200 {
+        t.Fatalf("POST plan: expected 200: received: %d\n%s", res.StatusCode, body)
+    }
+
+    assignURL := fmt.Sprintf("%s/api/admin/clients/%s?plan=no-such-plan", baseURL, email)
+    if res, _ := adminRequest("POST", assignURL); res.StatusCode != 404 {
+        t.Errorf("POST %s: expected 404: received: %d", assignURL, res.StatusCode)
+    }
+
+    assignURL = fmt.Sprintf("%s/api/admin/clients/%s?plan=test-single", baseURL, email)
+    if res, body := adminRequest("POST", assignURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", assignURL, res.StatusCode, body)
+    }
+
+    if res := postWithKey(key, secondURL); res.StatusCode != 429 {
+        t.Errorf("POST %s after assigning a one mutex plan: expected 429: received: %d", secondURL,
+                res.StatusCode)
+    }
+
+    // changing the plan applies to the clients assigned to it
+    if res, body := savePlan(`{"maxWaitMs":1000,"maxMutexes":2}`); res.StatusCode != 200 {
+        t.Fatalf("POST plan: expected 200: received: %d\n%s", res.StatusCode, body)
+    }
+
+    if res := postWithKey(key, secondURL); res.StatusCode != 200 {
+        t.Errorf("POST %s after raising the plan's limit: expected 200: received: %d", secondURL,
+                res.StatusCode)
+    }
+
+    plansURL := fmt.Sprintf("%s/api/admin/plans", baseURL)
+    res, body := adminRequest("GET", plansURL)
+    if res.StatusCode != 200 || !strings.Contains(string(body), `"name":"test-single","maxWaitMs":1000`) {
+        t.Errorf("GET %s: expected test-single: received: %d\n%s", plansURL, res.StatusCode, body)
+    }
+}
+
+// An old holder's unlock without a token mustn't release the lock of a
+// client that acquired the mutex after it was force-released.
+func TestTokenlessUnlock(t *testing.T) {
+    otherEmail := fmt.Sprintf("tokenless-%d@mutex.us", time.Now().Unix())
+    otherKey := registerTestClient(t, otherEmail)
+
+    namespaceURL := fmt.Sprintf("%s/api/namespaces/tokenless", baseURL)
+    postWithKey(clientID, namespaceURL + "?create")
+    if res := postWithKey(clientID, namespaceURL + "?grant&email=" + otherEmail); res.StatusCode != 200 {
+        t.Fatalf("POST %s?grant: expected 200: received: %d", namespaceURL, res.StatusCode)
+    }
+
+    mutexURL := fmt.Sprintf("%s/api/mutex/tokenless-test", baseURL)
+    lockURL := mutexURL + "?lock&waitTimeoutMs=0&namespace=tokenless"
+    unlockURL := mutexURL + "?unlock&namespace=tokenless"
+
+    if res, _ := lockWithKey(clientID, lockURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d", lockURL, res.StatusCode)
+    }
+
+    releaseURL := fmt.Sprintf("%s/api/admin/mutexes/tokenless-test?release&namespace=tokenless", baseURL)
+    if res, body := adminRequest("POST", releaseURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received: %d\n%s", releaseURL, res.StatusCode, body)
+    }
+
+    if res, _ := lockWithKey(otherKey, lockURL); res.StatusCode != 200 {
+        t.Fatalf("POST %s by another client: expected 200: received: %d", lockURL, res.StatusCode)
+    }
+
+    if res := postWithKey(clientID, unlockURL); res.StatusCode != 400 {
+        t.Errorf("POST %s without token by the old holder: expected 400: received: %d", unlockURL,
+                res.StatusCode)
+    }
+
+    if locked, _ := GetMutexStatus(namespaceResources("tokenless"), "tokenless-test"); !locked {
+        t.Fatalf("tokenless unlock by the old holder released the new holder's lock")
+    }
+
+    // old clients may be allowed to unlock without a token
+    *TokenlessUnlock = true
+    defer func () { *TokenlessUnlock = false }()
+
+    if res := postWithKey(otherKey, unlockURL); res.StatusCode != 200 {
+        t.Errorf("POST %s with -tokenlessUnlock: expected 200: received: %d", unlockURL, res.StatusCode)
+    }
+}
+
+func TestDashboard(t *testing.T) {
+    for _, path := range []string{"/dashboard/", "/dashboard/dashboard.js", "/favicon.ico"} {
+        res, _ := http.Get(baseURL + path)
+        ioutil.ReadAll(res.Body)
+        if res.StatusCode != 200 {
+            t.Errorf("GET %s: expected 200: received: %d", path, res.StatusCode)
+        }
+    }
+
+    savedDir := *Dir
+
+    // directories without an index aren't listed
+    staticDir, _ := ioutil.TempDir("", "mutex-static")
+    defer os.RemoveAll(staticDir)
+    os.Mkdir(filepath.Join(staticDir, "files"), 0755)
+    *Dir = staticDir
+    recorder := httptest.NewRecorder()
+    newStaticHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/files/", nil))
+    if recorder.Code != 404 {
+        t.Errorf("GET /files/ without index.html: expected 404: received: %d", recorder.Code)
+    }
+
+    // the embedded copy is served when -dir doesn't exist
+    *Dir = filepath.Join(os.TempDir(), "mutex-no-such-dir")
+    embeddedHandler := newStaticHandler()
+    *Dir = savedDir
+
+    recorder = httptest.NewRecorder()
+    embeddedHandler.ServeHTTP(recorder, httptest.NewRequest("GET", "/dashboard/", nil))
+    if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), "Mutex.Us Dashboard") {
+        t.Errorf("embedded GET /dashboard/: expected dashboard: received: %d", recorder.Code)
+    }
+
+    mutexURL := fmt.Sprintf("%s/api/mutex/dashboard-test", baseURL)
+    _, token := lockWithKey(clientID, mutexURL + "?lock")
+    defer postWithKey(clientID, fmt.Sprintf("%s?unlock&token=%d", mutexURL, token))
+
+    dashboardURL := fmt.Sprintf("%s/api/dashboard", baseURL)
+    req, _ := http.NewRequest("GET", dashboardURL, nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ := http.DefaultClient.Do(req)
+    body, _ := ioutil.ReadAll(res.Body)
+
+    var state DashboardState
+    if err := json.Unmarshal(body, &state); err != nil || res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected 200: received: %d\n%s", dashboardURL, res.StatusCode, body)
+    }
+
+    found := false
+    for _, mutex := range state.Mutexes {
+        found = found || (mutex.Identifier == "dashboard-test" && mutex.Locked && mutex.Resources == "")
+    }
+    if !found || len(state.Events) == 0 {
+        t.Errorf("GET %s: expected locked dashboard-test mutex and events: %s", dashboardURL, body)
+    }
+
+    // the newest events, newest first
+    if len(state.Events) > dashboardEvents || len(state.Events) > 0 && (state.Events[0].Identifier != "dashboard-test" ||
+            state.Events[0].Action != AuditLock) {
+        t.Errorf("GET %s: expected at most %d events, starting with the dashboard-test lock: %s", dashboardURL,
+                dashboardEvents, body)
+    }
+
+    adminURL := fmt.Sprintf("%s/api/admin/dashboard", baseURL)
+    res, body = adminRequest("GET", adminURL)
+    if res.StatusCode != 200 || !strings.Contains(string(body), `"resources":"` + testEmail + `"`) {
+        t.Errorf("GET %s: expected mutexes labelled with their client: %d\n%s", adminURL, res.StatusCode, body)
+    }
+}
+
+func TestContentionStats(t *testing.T) {
+    var samples durationSamples
+    for i := 1; i <= 100; i++ {
+        samples.add(time.Duration(i) * time.Millisecond)
+    }
+    if samples.percentile(0.5) != 50 * time.Millisecond || samples.percentile(0.99) != 99 * time.Millisecond {
+        t.Errorf("percentiles of 1..100ms: p50 %v p99 %v", samples.percentile(0.5), samples.percentile(0.99))
+    }
+
+    hotURL := fmt.Sprintf("%s/api/mutex/stats-hot", baseURL)
+    coldURL := fmt.Sprintf("%s/api/mutex/stats-cold", baseURL)
+
+    _, token := lockWithKey(clientID, coldURL + "?lock")
+    postWithKey(clientID, fmt.Sprintf("%s?unlock&token=%d", coldURL, token))
+
+    _, token = lockWithKey(clientID, hotURL + "?lock")
+    done := make(chan bool)
+    for i := 0; i < 2; i++ {
+        go func () {
+            postWithKey(clientID, hotURL + "?lock&waitTimeoutMs=100")
+            done <- true
+        }()
+    }
+    <-done
+    <-done
+    postWithKey(clientID, fmt.Sprintf("%s?unlock&token=%d", hotURL, token))
+
+    statsURL := fmt.Sprintf("%s/api/stats?top=1", baseURL)
+    req, _ := http.NewRequest("GET", statsURL, nil)
+    req.Header.Set("Authorization", "Bearer " + clientID)
+    res, _ := http.DefaultClient.Do(req)
+    body, _ := ioutil.ReadAll(res.Body)
+
+    var stats []HttpMutexStats
+    if err := json.Unmarshal(body, &stats); err != nil || res.StatusCode != 200 || len(stats) != 1 {
+        t.Fatalf("GET %s: expected one mutex: received: %d\n%s", statsURL, res.StatusCode, body)
+    }
+
+    hot := stats[0]
+    if hot.Identifier != "stats-hot" || hot.Contended != 2 || hot.Timeouts != 2 || hot.Acquires != 1 ||
+            hot.MaxQueueDepth != 2 || hot.WaitP99Ms < 50 || hot.HoldP50Ms < 50 {
+        t.Errorf("GET %s: unexpected stats for the most contended mutex: %s", statsURL, body)
+    }
+}
+
+func TestEviction(t *testing.T) {
+    account := "eviction-test@mutex.us"
+    ctx := context.Background()
+
+    token, err := LockSemaphore(ctx, account, "held", 0, 0)
+    if err != nil {
+        t.Fatalf("LockSemaphore(held): %v", err)
+    }
+    idleToken, _ := LockSemaphore(ctx, account, "idle", 0, 0)
+    UnlockSemaphore(account, "idle", idleToken)
+    TakeTokens(ctx, account, "limiter", 1, 1000, 1, 0)
+
+    result := EvictIdle(0)
+    if result.Mutexes < 1 {
+        t.Errorf("EvictIdle: expected the idle mutex to be evicted: %+v", result)
+    }
+
+    cr := getClientResources(account)
+    cr.mu.RLock()
+    _, heldKept := cr.semaphoreMap["held"]
+    _, idleKept := cr.semaphoreMap["idle"]
+    cr.mu.RUnlock()
+    if !heldKept || idleKept || cr.evicted {
+        t.Errorf("EvictIdle: held kept %v, idle kept %v, client evicted %v", heldKept, idleKept, cr.evicted)
+    }
+
+    if _, err := UnlockSemaphore(account, "held", token); err != nil {
+        t.Fatalf("UnlockSemaphore(held) after eviction: %v", err)
+    }
+
+    time.Sleep(5 * time.Millisecond)
+    EvictIdle(0)
+
+    crmMutex.RLock()
+    _, clientKept := clientResourceMap[account]
+    crmMutex.RUnlock()
+    if clientKept || !cr.evicted {
+        t.Errorf("EvictIdle: client without resources not evicted")
+    }
+}
+
+// Lock and unlock a few mutexes from many goroutines while evicting
+// continuously: no mutex may ever have two holders.
+func TestEvictionRace(t *testing.T) {
+    account := "eviction-race@mutex.us"
+    ctx := context.Background()
+    identifiers := []string{"a", "b", "c"}
+    holders := make([]int32, len(identifiers))
+
+    stop := make(chan bool)
+    evictorDone := make(chan bool)
+    go func () {
+        for {
+            select {
+            case <-stop:
+                evictorDone <- true
+                return
+            default:
+                EvictIdle(0)
+            }
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func (g int) {
+            defer wg.Done()
+
+            for i := 0; i < 100; i++ {
+                n := (g + i) % len(identifiers)
+                token, err := LockSemaphore(ctx, account, identifiers[n], time.Second, 0)
+                if err != nil {
+                    t.Errorf("LockSemaphore(%s): %v", identifiers[n], err)
+                    return
+                }
+
+                if atomic.AddInt32(&holders[n], 1) != 1 {
+                    t.Errorf("mutex %s has more than one holder", identifiers[n])
+                }
+                atomic.AddInt32(&holders[n], -1)
+
+                if _, err := UnlockSemaphore(account, identifiers[n], token); err != nil {
+                    t.Errorf("UnlockSemaphore(%s): %v", identifiers[n], err)
+                    return
+                }
+
+                TakeTokens(ctx, account, identifiers[n], 1, 100000, 100, 0)
+            }
+        }(g)
+    }
+    wg.Wait()
+
+    close(stop)
+    <-evictorDone
+
+    cr := getClientResources(account)
+    cr.mu.RLock()
+    held := cr.heldMutexes
+    cr.mu.RUnlock()
+    if held != 0 {
+        t.Errorf("after all unlocks: %d mutexes still held", held)
+    }
+}
+
+func resetDrain() {
+    atomic.StoreInt32(&draining, 0)
+    drainChannel = make(chan struct{})
+    drainOnce = sync.Once{}
+}
+
+func TestDrain(t *testing.T) {
+    account := "drain-test@mutex.us"
+    ctx := context.Background()
+    lockURL := fmt.Sprintf("%s/api/mutex/drain-test?lock&waitTimeoutMs=10000", baseURL)
+
+    defer resetDrain()
+
+    res, restToken := lockWithKey(clientID, lockURL)
+    if res.StatusCode != 200 {
+        t.Fatalf("POST %s: expected 200: received %d", lockURL, res.StatusCode)
+    }
+
+    token, err := LockSemaphore(ctx, account, "leased", 0, time.Hour)
+    if err != nil {
+        t.Fatalf("LockSemaphore(leased): %v", err)
+    }
+
+    waiter := make(chan *http.Response)
+    go func () {
+        waiter <- postWithKey(clientID, lockURL)
+    }()
+    time.Sleep(50 * time.Millisecond)
+
+    StartDrain()
+
+    if res := <-waiter; res.StatusCode != 503 || res.Header.Get("Retry-After") == "" {
+        t.Errorf("POST %s while draining: expected 503 with Retry-After: received %d %q", lockURL,
+                res.StatusCode, res.Header.Get("Retry-After"))
+    }
+
+    otherURL := fmt.Sprintf("%s/api/mutex/drain-other?lock", baseURL)
+    if res := postWithKey(clientID, otherURL); res.StatusCode != 503 {
+        t.Errorf("POST %s after draining started: expected 503: received %d", otherURL, res.StatusCode)
+    }
+
+    saved, err := SaveHeldLocks()
+    if err != nil || saved < 2 {
+        t.Fatalf("SaveHeldLocks: expected at least 2 locks: saved %d: %v", saved, err)
+    }
+
+    // simulate a restart
+    crmMutex.Lock()
+    for _, cr := range clientResourceMap {
+        cr.mu.Lock()
+        cr.evicted = true
+        cr.mu.Unlock()
+    }
+    clientResourceMap = map[string]*ClientResources{}
+    crmMutex.Unlock()
+
+    if restored, err := RestoreHeldLocks(); err != nil || restored != saved {
+        t.Fatalf("RestoreHeldLocks: expected %d locks: restored %d: %v", saved, restored, err)
+    }
+
+    if _, err := LockSemaphore(context.Background(), account, "fresh", 0, 0); !errors.Is(err, ErrDraining) {
+        t.Errorf("LockSemaphore while draining: expected ErrDraining: received %v", err)
+    }
+
+    cr := getClientResources(account)
+    cr.mu.RLock()
+    leaseExpires := cr.semaphoreMap["leased"].leaseExpires
+    cr.mu.RUnlock()
+    if time.Until(leaseExpires) < 50 * time.Minute {
+        t.Errorf("restored lease expires at %v", leaseExpires)
+    }
+
+    if _, err := UnlockSemaphore(account, "leased", token + 1); !errors.Is(err, ErrStaleToken) {
+        t.Errorf("UnlockSemaphore with the wrong token after restore: expected ErrStaleToken: received %v", err)
+    }
+    if _, err := UnlockSemaphore(account, "leased", token); err != nil {
+        t.Errorf("UnlockSemaphore with the saved token after restore: %v", err)
+    }
+
+    unlockURL := fmt.Sprintf("%s/api/mutex/drain-test?unlock&token=%d", baseURL, restToken)
+    if res := postWithKey(clientID, unlockURL); res.StatusCode != 200 {
+        t.Errorf("POST %s after restore: expected 200: received %d", unlockURL, res.StatusCode)
+    }
+
+    if restored, _ := RestoreHeldLocks(); restored != 0 {
+        t.Errorf("RestoreHeldLocks: saved locks restored twice")
+    }
+}
+
+// A store whose database never answers a ping.
+type stalledStore struct {
+    persist.Store
+}
+
+func (s stalledStore) Ping(ctx context.Context) error {
+    <-ctx.Done()
+
+    return fmt.Errorf("dial tcp db.internal:5432: %w", ctx.Err())
+}
+
+func TestHealth(t *testing.T) {
+    defer resetDrain()
+
+    for _, path := range []string{"/healthz", "/readyz", "/version"} {
+        res, err := http.Get(baseURL + path)
+        if err != nil || res.StatusCode != 200 {
+            t.Fatalf("GET %s: expected 200: received %v %v", path, res, err)
+        }
+    }
+
+    var buildVersion HttpVersion
+    res, _ := http.Get(baseURL + "/version")
+    body, _ := ioutil.ReadAll(res.Body)
+    if json.Unmarshal(body, &buildVersion) != nil || buildVersion.Version != version || buildVersion.GoVersion == "" {
+        t.Errorf("GET /version: unexpected response: %s", body)
+    }
+
+    // a stalled database fails the probe within its timeout, without
+    // describing the database
+    savedTimeout := readyzPingTimeout
+    readyzPingTimeout = 50 * time.Millisecond
+    persist.Use(stalledStore{persist.Current()})
+
+    var readiness HttpReadiness
+    res, _ = http.Get(baseURL + "/readyz")
+    body, _ = ioutil.ReadAll(res.Body)
+    persist.Use(persist.Current().(stalledStore).Store)
+    readyzPingTimeout = savedTimeout
+
+    if res.StatusCode != 503 || json.Unmarshal(body, &readiness) != nil || readiness.Database != "unavailable" {
+        t.Errorf("GET /readyz with a stalled database: expected 503 and unavailable: received %d %s",
+                res.StatusCode, body)
+    }
+
+    StartDrain()
+
+    readiness = HttpReadiness{}
+    res, _ = http.Get(baseURL + "/readyz")
+    body, _ = ioutil.ReadAll(res.Body)
+    if res.StatusCode != 503 || json.Unmarshal(body, &readiness) != nil || readiness.Ready || !readiness.Draining {
+        t.Errorf("GET /readyz while draining: expected 503: received %d %s", res.StatusCode, body)
+    }
+
+    if res, _ := http.Get(baseURL + "/healthz"); res.StatusCode != 200 {
+        t.Errorf("GET /healthz while draining: expected 200: received %d", res.StatusCode)
+    }
+}
+
+func TestBackup(t *testing.T) {
+    email := fmt.Sprintf("backup-%d@mutex.us", time.Now().Unix())
+    apiKey := registerTestClient(t, email)
+
+    mutexURL := fmt.Sprintf("%s/api/mutex/backup-test", baseURL)
+    if res := postWithKey(apiKey, mutexURL + "?lock"); res.StatusCode != 200 {
+        t.Fatalf("POST %s?lock: expected 200: received %d", mutexURL, res.StatusCode)
+    }
+
+    backupURL := fmt.Sprintf("%s/api/admin/backup", baseURL)
+    res, body := adminRequest("GET", backupURL)
+    if res.StatusCode != 200 || !bytes.HasPrefix(body, []byte("SQLite format 3\x00")) {
+        t.Fatalf("GET %s: expected an SQLite database: received %d", backupURL, res.StatusCode)
+    }
+
+    path := filepath.Join(t.TempDir(), "backup.db")
+    if err := ioutil.WriteFile(path, body, 0600); err != nil {
+        t.Fatal(err)
+    }
+    backup, err := persist.NewSQLiteStore(path)
+    if err != nil {
+        t.Fatalf("opening backup: %v", err)
+    }
+    defer backup.Close()
+    if err = backup.Find(context.Background(), &ClientInfo{Email: email}); err != nil {
+        t.Errorf("Find(%s) in backup: %v", email, err)
+    }
+
+    exportURL := fmt.Sprintf("%s/api/admin/export", baseURL)
+    res, body = adminRequest("GET", exportURL)
+    var export Export
+    if err = json.Unmarshal(body, &export); err != nil || res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected an export: received %d: %v", exportURL, res.StatusCode, err)
+    }
+
+    held := false
+    for _, heldLock := range export.HeldLocks {
+        held = held || (heldLock.Resources == email && heldLock.Identifier == "backup-test")
+    }
+    if !held {
+        t.Errorf("GET %s: backup-test not among held locks: %+v", exportURL, export.HeldLocks)
+    }
+
+    // this instance has clients, so it can't import
+    importURL := fmt.Sprintf("%s/api/admin/import", baseURL)
+    req, _ := http.NewRequest("POST", importURL, bytes.NewReader(body))
+    req.Header.Set("Authorization", "Bearer " + *AdminID)
+    res, _ = http.DefaultClient.Do(req)
+    ioutil.ReadAll(res.Body)
+    if res.StatusCode != 409 {
+        t.Errorf("POST %s: expected 409: received %d", importURL, res.StatusCode)
+    }
+
+    live := persist.Current()
+    persist.Use(persist.NewMemoryStore())
+    defer persist.Use(live)
+
+    imported, err := ImportState(&export)
+    if err != nil || imported < len(export.Clients) + len(export.Keys) + len(export.HeldLocks) {
+        t.Fatalf("ImportState into a fresh store: imported %d: %v", imported, err)
+    }
+
+    if _, err = FindClient(email); err != nil {
+        t.Errorf("FindClient(%s) after import: %v", email, err)
+    }
+
+    heldLocks := []HeldLock{}
+    persist.FindAll(&HeldLock{}, &heldLocks)
+    if len(heldLocks) != len(export.HeldLocks) {
+        t.Errorf("after import: expected %d held locks saved: found %d", len(export.HeldLocks), len(heldLocks))
+    }
+
+    if _, err = ImportState(&export); !errors.Is(err, ErrNotFresh) {
+        t.Errorf("ImportState again: expected ErrNotFresh: %v", err)
+    }
+}
+
+func TestRegistrationLimits(t *testing.T) {
+    *RegistrationsPerHour = 2
+    defer func () {
+        *RegistrationsPerHour = 0
+        registrationMutex.Lock()
+        registrationLimiters = map[string]*ratelimit.TokenBucket{}
+        registrationMutex.Unlock()
+    }()
+
+    // links in the email use -baseURL whatever the request's Host header
+    email := fmt.Sprintf("limited-%d@mutex.us", time.Now().Unix())
+    registerURL := fmt.Sprintf("%s/api/client?register&email=%s", baseURL, email)
+    req, _ := http.NewRequest("POST", registerURL, nil)
+    req.Host = "attacker.example"
+    res, _ := http.DefaultClient.Do(req)
+    ioutil.ReadAll(res.Body)
+    verifyURLs := verificationLink.FindAllString(mailBuffer.String(), -1)
+    if res.StatusCode != 202 || !strings.HasPrefix(verifyURLs[len(verifyURLs)-1], baseURL + "/") {
+        t.Errorf("POST %s with a forged Host: expected a link to %s: received %d %s", registerURL, baseURL,
+                res.StatusCode, verifyURLs[len(verifyURLs)-1])
+    }
+
+    if res, _ = http.PostForm(registerURL, nil); res.StatusCode != 202 {
+        t.Errorf("POST %s again: expected 202: received %d", registerURL, res.StatusCode)
+    }
+
+    res, _ = http.PostForm(registerURL, nil)
+    if res.StatusCode != 429 || res.Header.Get("Retry-After") == "" {
+        t.Errorf("POST %s a third time: expected 429 with Retry-After: received %d", registerURL, res.StatusCode)
+    }
+
+    // confirming deletes the registration, and expired ones are swept
+    if res, _ = http.Get(verifyURLs[len(verifyURLs)-1]); res.StatusCode != 200 {
+        t.Fatalf("GET %s: expected 200: received %d", verifyURLs[len(verifyURLs)-1], res.StatusCode)
+    }
+    pendings := []PendingRegistration{}
+    persist.FindAll(&PendingRegistration{Email: email}, &pendings)
+    if len(pendings) != 1 {
+        t.Errorf("after confirming: expected only the unconfirmed registration: found %d", len(pendings))
+    }
+
+    sweepRegistrations(time.Now().Add(VerificationTTL + time.Minute))
+    pendings = []PendingRegistration{}
+    persist.FindAll(&PendingRegistration{Email: email}, &pendings)
+    if len(pendings) != 0 {
+        t.Errorf("after sweeping: expected no registrations: found %d", len(pendings))
+    }
+}
@@ -0,0 +1,133 @@
+// Prometheus metrics and the HTTP instrumentation that feeds them.
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "mutex/server/metrics"
+)
+
+var metricsRegistry = metrics.NewRegistry()
+
+var (
+    lockAcquisitions = metricsRegistry.NewCounter("mutex_lock_acquisitions_total",
+            "Mutex locks acquired.")
+    lockReleases = metricsRegistry.NewCounter("mutex_lock_releases_total",
+            "Mutex locks released, by reason (unlock, lease_expired or forced).", "reason")
+    lockTimeouts = metricsRegistry.NewCounter("mutex_lock_timeouts_total",
+            "Lock requests that gave up waiting.")
+    lockDisconnects = metricsRegistry.NewCounter("mutex_lock_disconnects_total",
+            "Lock requests abandoned by the client while waiting.")
+    lockWaitSeconds = metricsRegistry.NewHistogram("mutex_lock_wait_seconds",
+            "Time lock requests spent waiting for a mutex, whether or not they acquired it.",
+            metrics.DefaultBuckets)
+    lockHoldSeconds = metricsRegistry.NewHistogram("mutex_lock_hold_seconds",
+            "Time mutexes were held before being released.", metrics.DefaultBuckets)
+    rateLimitTakes = metricsRegistry.NewCounter("mutex_ratelimit_takes_total",
+            "Rate limiter take requests, by outcome (ok or limited).", "outcome")
+    httpRequestSeconds = metricsRegistry.NewHistogram("mutex_http_request_duration_seconds",
+            "HTTP request latency by route and status code.", metrics.DefaultBuckets, "route", "code")
+)
+
+func init() {
+    metricsRegistry.NewGaugeFunc("mutex_locks_held", "Mutexes currently held.", func () float64 {
+        held, _ := countHeldAndWaiting()
+        return float64(held)
+    })
+    metricsRegistry.NewGaugeFunc("mutex_lock_waiters", "Lock requests currently waiting.", func () float64 {
+        _, waiting := countHeldAndWaiting()
+        return float64(waiting)
+    })
+}
+
+func countHeldAndWaiting() (held int, waiting int) {
+    crmMutex.RLock()
+    defer crmMutex.RUnlock()
+
+    for _, cr := range clientResourceMap {
+        cr.mu.RLock()
+        held += cr.heldMutexes
+        for _, state := range cr.semaphoreMap {
+            waiting += state.waiters
+        }
+        cr.mu.RUnlock()
+    }
+
+    return held, waiting
+}
+
+// Serve /metrics to the admin (see isAdmin) only; the -metricsAddr listener
+// serves it to anyone who can reach it.
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+    if !isAdmin(req) {
+        reportError(w, req, 401, "admin credential required")
+
+        return
+    }
+
+    metricsRegistry.Handler().ServeHTTP(w, req)
+}
+
+// The route label for a request path. Identifiers (and keys in legacy
+// paths) are dropped so that label cardinality stays bounded and no
+// secrets end up in metrics.
+func routeLabel(path string) string {
+    pathParams := strings.Split(path, "/")
+
+    if len(pathParams) >= 5 && pathParams[1] == "api" && pathParams[2] == "client" {
+        pathParams = append([]string{"", "api"}, pathParams[4:]...)
+    }
+
+    switch {
+    case len(pathParams) >= 3 && pathParams[1] == "api":
+        switch pathParams[2] {
+        case "client", "mutex", "ratelimit", "keys", "namespaces", "audit", "admin", "dashboard", "stats":
+            return "/api/" + pathParams[2]
+        default:
+            return "/api/other"
+        }
+    case path == "/stats" || path == "/metrics" || path == "/healthz" || path == "/readyz" || path == "/version":
+        return path
+    default:
+        return "/"
+    }
+}
+
+type statusRecorder struct {
+    http.ResponseWriter
+    statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+    if r.statusCode == 0 {
+        r.statusCode = statusCode
+    }
+    r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+    if r.statusCode == 0 {
+        r.statusCode = 200
+    }
+    return r.ResponseWriter.Write(data)
+}
+
+// Record the latency and status code of every request.
+func instrumentHandler(next http.Handler) http.Handler {
+    return http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
+        start := time.Now()
+        recorder := &statusRecorder{ResponseWriter: w}
+
+        next.ServeHTTP(recorder, req)
+
+        if recorder.statusCode == 0 {
+            recorder.statusCode = 200
+        }
+
+        httpRequestSeconds.Observe(time.Since(start).Seconds(), routeLabel(req.URL.Path),
+                strconv.Itoa(recorder.statusCode))
+    })
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+
+	counter := registry.NewCounter("test_total", "A test counter.", "outcome")
+	counter.Inc("ok")
+	counter.Add(2, `say "hi"`)
+
+	gauge := registry.NewGauge("test_gauge", "A test gauge.")
+	gauge.Add(3)
+	gauge.Add(-1)
+
+	registry.NewGaugeFunc("test_func", "A computed gauge.", func() float64 { return 7 })
+
+	histogram := registry.NewHistogram("test_seconds", "A test histogram.", []float64{0.1, 1}, "route")
+	histogram.Observe(0.05, "/api")
+	histogram.Observe(0.5, "/api")
+	histogram.Observe(5, "/api")
+
+	var buffer bytes.Buffer
+	if err := registry.Write(&buffer); err != nil {
+		t.Fatalf("Write: unexpected error: %v", err)
+	}
+	output := buffer.String()
+
+	for _, expected := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{outcome="ok"} 1` + "\n",
+		`test_total{outcome="say \"hi\""} 2` + "\n",
+		"test_gauge 2\n",
+		"test_func 7\n",
+		`test_seconds_bucket{route="/api",le="0.1"} 1` + "\n",
+		`test_seconds_bucket{route="/api",le="1"} 2` + "\n",
+		`test_seconds_bucket{route="/api",le="+Inf"} 3` + "\n",
+		`test_seconds_sum{route="/api"} 5.55` + "\n",
+		`test_seconds_count{route="/api"} 3` + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output missing %q:\n%s", expected, output)
+		}
+	}
+}
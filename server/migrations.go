@@ -0,0 +1,85 @@
+// Schema migrations, applied in version order when the database is opened.
+// Never change or renumber a migration once released; add a new one.
+package main
+
+import (
+    "fmt"
+
+    "database/sql"
+    "mutex/server/persist"
+)
+
+func init() {
+    persist.RegisterMigration(persist.Migration{
+        Version: 1,
+        Name: "index key records by prefix",
+        Records: []interface{}{&KeyRecord{}},
+        SQL: createIndexSQL(&KeyRecord{}, "Prefix"),
+    })
+    persist.RegisterMigration(persist.Migration{
+        Version: 2,
+        Name: "index namespace grants",
+        Records: []interface{}{&NamespaceGrant{}},
+        SQL: createIndexSQL(&NamespaceGrant{}, "Namespace", "Email"),
+    })
+    persist.RegisterMigration(persist.Migration{
+        Version: 3,
+        Name: "index audit events by resources",
+        Records: []interface{}{&AuditEvent{}},
+        SQL: createIndexSQL(&AuditEvent{}, "Resources", "Identifier"),
+    })
+    persist.RegisterMigration(persist.Migration{
+        Version: 4,
+        Name: "store strings as text",
+        Dialect: "sqlite3",
+        Up: persist.ConvertStringColumns,
+    })
+    persist.RegisterMigration(persist.Migration{
+        Version: 5,
+        Name: "hash plaintext keys",
+        UpRecords: migratePlaintextKeys,
+    })
+    // only once the keys have been copied
+    persist.RegisterMigration(persist.Migration{
+        Version: 6,
+        Name: "drop plaintext key tables",
+        Up: func (tx *sql.Tx) error {
+            for _, r := range []interface{}{&ApiKey{}, &RevokedKey{}} {
+                if _, err := tx.Exec("drop table if exists " + persist.TableName(r)); err != nil {
+                    return err
+                }
+            }
+
+            return nil
+        },
+    })
+    persist.RegisterMigration(persist.Migration{
+        Version: 7,
+        Name: "index audit events by time",
+        Records: []interface{}{&AuditEvent{}},
+        Up: func (tx *sql.Tx) error {
+            for _, columns := range [][]string{{"Resources", "Time"}, {"Time"}} {
+                if _, err := tx.Exec(createIndexSQL(&AuditEvent{}, columns...)); err != nil {
+                    return err
+                }
+            }
+
+            return nil
+        },
+    })
+}
+
+func createIndexSQL(r interface{}, columns ...string) string {
+    tableName := persist.TableName(r)
+    name := tableName
+    list := ""
+    for i, column := range columns {
+        name += "_" + column
+        if i > 0 {
+            list += ", "
+        }
+        list += `"` + column + `"`
+    }
+
+    return fmt.Sprintf("create index if not exists %s on %s (%s)", name, tableName, list)
+}
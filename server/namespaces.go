@@ -0,0 +1,289 @@
+// Shared namespaces: every account has a private namespace of its own,
+// and may create named namespaces which other accounts can be granted
+// access to so that they can contend on the same mutexes.
+package main
+
+import (
+    "fmt"
+    "sync"
+    "errors"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "mutex/server/persist"
+)
+
+type Namespace struct {
+    Name string `json:"name" db-pk:"true"`
+    Owner string `json:"owner"`
+    Created int64 `json:"created"`
+}
+
+// Access to a namespace granted to an account. Like keys, grants are never
+// modified: revoking one records a GrantRevocation.
+type NamespaceGrant struct {
+    ID string `db-pk:"true"`
+    Namespace string
+    Email string
+    Granted int64
+}
+
+type GrantRevocation struct {
+    ID string `db-pk:"true"`
+    Revoked int64
+}
+
+// The namespaces an account may use, as listed to it.
+type NamespaceInfo struct {
+    Name string `json:"name"`
+    Owner string `json:"owner"`
+    Members []string `json:"members,omitempty"`
+}
+
+// Resources for shared namespaces are kept in clientResourceMap alongside
+// accounts' private resources, under a key that can't be an email address.
+const namespaceResourcePrefix = "namespace:"
+
+var namespaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var ErrNamespaceNotFound = errors.New("namespace not found")
+var ErrNamespaceAccess = errors.New("namespace access denied")
+
+type namespaceAccessEntry struct {
+    allowed bool
+    expires time.Time
+}
+
+var namespaceAccessMutex sync.RWMutex
+var namespaceAccessCache = map[string]namespaceAccessEntry{}
+
+func namespaceResources(name string) string {
+    return namespaceResourcePrefix + name
+}
+
+func FindNamespace(name string) (*Namespace, error) {
+    namespace := Namespace{
+        Name: name,
+    }
+
+    if name == "" || persist.Find(&namespace) != nil {
+        return nil, fmt.Errorf("%w: '%s'", ErrNamespaceNotFound, name)
+    }
+
+    return &namespace, nil
+}
+
+func grantRevoked(grant *NamespaceGrant) bool {
+    revocation := GrantRevocation{
+        ID: grant.ID,
+    }
+
+    return grant.ID != "" && persist.Find(&revocation) == nil
+}
+
+// Find the active grants matching the non-empty fields of filter.
+func findActiveGrants(filter *NamespaceGrant) (active []NamespaceGrant) {
+    grants := []NamespaceGrant{}
+    persist.FindAll(filter, &grants)
+
+    for _, grant := range grants {
+        if !grantRevoked(&grant) {
+            active = append(active, grant)
+        }
+    }
+
+    return active
+}
+
+func CreateNamespace(account string, name string) (*Namespace, error) {
+    if !namespaceNamePattern.MatchString(name) {
+        return nil, errors.New(fmt.Sprintf("invalid namespace name '%s' (use up to 64 letters, digits, '.', '_' or '-')",
+                name))
+    }
+
+    namespace := &Namespace{
+        Name: name,
+        Owner: account,
+        Created: time.Now().Unix(),
+    }
+
+    if err := persist.Insert(namespace); err != nil {
+        if errors.Is(err, persist.ErrDuplicate) {
+            return nil, errors.New(fmt.Sprintf("namespace '%s' already exists", name))
+        }
+
+        return nil, err
+    }
+
+    return namespace, nil
+}
+
+// Look up a namespace owned by account.
+func findOwnedNamespace(account string, name string) (*Namespace, error) {
+    namespace, err := FindNamespace(name)
+    if err != nil {
+        return nil, err
+    }
+
+    if namespace.Owner != account {
+        return nil, fmt.Errorf("%w: only the owner of namespace '%s' may manage it", ErrNamespaceAccess, name)
+    }
+
+    return namespace, nil
+}
+
+func GrantNamespace(account string, name string, email string) error {
+    if _, err := findOwnedNamespace(account, name); err != nil {
+        return err
+    }
+
+    if _, err := FindClient(email); err != nil {
+        return errors.New(fmt.Sprintf("no client is registered as '%s'", email))
+    }
+
+    if email == account || len(findActiveGrants(&NamespaceGrant{Namespace: name, Email: email})) > 0 {
+        return nil
+    }
+
+    if err := persist.Insert(&NamespaceGrant{
+        ID: uuid.New().String(),
+        Namespace: name,
+        Email: email,
+        Granted: time.Now().Unix(),
+    }); err != nil {
+        return err
+    }
+
+    forgetNamespaceAccess(email, name)
+
+    return nil
+}
+
+func RevokeNamespace(account string, name string, email string) error {
+    if _, err := findOwnedNamespace(account, name); err != nil {
+        return err
+    }
+
+    for _, grant := range findActiveGrants(&NamespaceGrant{Namespace: name, Email: email}) {
+        if err := persist.Insert(&GrantRevocation{
+            ID: grant.ID,
+            Revoked: time.Now().Unix(),
+        }); err != nil {
+            return err
+        }
+    }
+
+    forgetNamespaceAccess(email, name)
+
+    return nil
+}
+
+func forgetNamespaceAccess(email string, name string) {
+    namespaceAccessMutex.Lock()
+    delete(namespaceAccessCache, email + "\x00" + name)
+    namespaceAccessMutex.Unlock()
+}
+
+// Drop expired entries from the namespace access cache.
+func sweepNamespaceAccessCache(now time.Time) {
+    namespaceAccessMutex.Lock()
+    defer namespaceAccessMutex.Unlock()
+
+    for cacheKey, entry := range namespaceAccessCache {
+        if now.After(entry.expires) {
+            delete(namespaceAccessCache, cacheKey)
+        }
+    }
+}
+
+// List the namespaces an account owns or has been granted access to. Only
+// owners see a namespace's members.
+func ListNamespaces(account string) []NamespaceInfo {
+    namespaceInfos := []NamespaceInfo{}
+
+    owned := []Namespace{}
+    persist.FindAll(&Namespace{
+        Owner: account,
+    }, &owned)
+
+    for _, namespace := range owned {
+        namespaceInfo := NamespaceInfo{
+            Name: namespace.Name,
+            Owner: namespace.Owner,
+            Members: []string{},
+        }
+
+        for _, grant := range findActiveGrants(&NamespaceGrant{Namespace: namespace.Name}) {
+            namespaceInfo.Members = append(namespaceInfo.Members, grant.Email)
+        }
+
+        namespaceInfos = append(namespaceInfos, namespaceInfo)
+    }
+
+    for _, grant := range findActiveGrants(&NamespaceGrant{Email: account}) {
+        if namespace, err := FindNamespace(grant.Namespace); err == nil {
+            namespaceInfos = append(namespaceInfos, NamespaceInfo{
+                Name: namespace.Name,
+                Owner: namespace.Owner,
+            })
+        }
+    }
+
+    return namespaceInfos
+}
+
+// Return the clientResourceMap key for the named namespace if account may
+// use it. An empty name is the account's private namespace. Access checks
+// are cached for -keyCacheTTL; granting or revoking access takes effect
+// immediately.
+func ResolveNamespace(account string, name string) (string, error) {
+    if name == "" {
+        return account, nil
+    }
+
+    cacheKey := account + "\x00" + name
+
+    namespaceAccessMutex.RLock()
+    entry, ok := namespaceAccessCache[cacheKey]
+    namespaceAccessMutex.RUnlock()
+
+    if !ok || time.Now().After(entry.expires) {
+        namespace, err := FindNamespace(name)
+        if err != nil {
+            return "", err
+        }
+
+        entry = namespaceAccessEntry{
+            allowed: namespace.Owner == account ||
+                    len(findActiveGrants(&NamespaceGrant{Namespace: name, Email: account})) > 0,
+            expires: time.Now().Add(KeyCacheTTL),
+        }
+
+        namespaceAccessMutex.Lock()
+        namespaceAccessCache[cacheKey] = entry
+        namespaceAccessMutex.Unlock()
+    }
+
+    if !entry.allowed {
+        return "", fmt.Errorf("%w: '%s'", ErrNamespaceAccess, name)
+    }
+
+    return namespaceResources(name), nil
+}
+
+// The email of the account whose plan governs a clientResourceMap entry:
+// the account itself, or a shared namespace's owner.
+func resourcesAccount(resources string) (string, error) {
+    if !strings.HasPrefix(resources, namespaceResourcePrefix) {
+        return resources, nil
+    }
+
+    namespace, err := FindNamespace(strings.TrimPrefix(resources, namespaceResourcePrefix))
+    if err != nil {
+        return "", err
+    }
+
+    return namespace.Owner, nil
+}
@@ -1,298 +1,588 @@
+// Reflection-based storage of structs as table rows. Records are stored
+// by a Store: SQLite, PostgreSQL or in memory.
 package persist
 
 import (
+    "context"
     "fmt"
-    "log"
     "reflect"
+    "sort"
     "strings"
     "errors"
+    "sync"
+    "time"
 
     "database/sql"
-    _ "github.com/mattn/go-sqlite3"
+    "encoding/json"
 )
 
-var tableSet map[string]reflect.Type
-var db *sql.DB
+// Operations on records, of a Store or within a transaction (see WithTx).
+type Records interface {
+    // Insert a new record. Inserting a record with the primary key or a
+    // db-unique column of another returns ErrDuplicate.
+    Insert(ctx context.Context, r interface{}) error
+    // Find the first record matching the non-zero fields of r, and
+    // populate r with it, or return ErrNotFound.
+    Find(ctx context.Context, r interface{}) error
+    // Find every record matching the non-zero fields of r, and append
+    // them to records, a pointer to a slice of r's type.
+    FindAll(ctx context.Context, r interface{}, records interface{}) error
+    // Find the records matching the non-zero fields of r within rng, in
+    // its order, and append them to records as FindAll does.
+    FindRange(ctx context.Context, r interface{}, rng Range, records interface{}) error
+    // Update the record with r's primary key, setting all of its other
+    // fields, or return ErrNotFound.
+    Update(ctx context.Context, r interface{}) error
+    // Insert r, or update the record with its primary key if there is one.
+    Upsert(ctx context.Context, r interface{}) error
+    // Delete the record with r's primary key. Deleting a record that
+    // doesn't exist is not an error.
+    Delete(ctx context.Context, r interface{}) error
+    // Delete the records matching the non-zero fields of r within rng's
+    // bounds, returning how many were deleted.
+    DeleteRange(ctx context.Context, r interface{}, rng Range) (int64, error)
+}
 
-type scanner func(*sql.Rows)
+// Bounds and orders records by one field, for FindRange and DeleteRange.
+// The zero Range selects every record, in no particular order.
+type Range struct {
+    // the name of the struct field to bound and order by
+    Field string
+    // if not nil, only records whose field is at least From
+    From interface{}
+    // if not nil, only records whose field is less than Before
+    Before interface{}
+    // greatest first; records with equal fields are ordered by primary key
+    Descending bool
+    // if not zero, at most Limit records are found
+    Limit int
+}
 
-var goToSqliteKindMap map[reflect.Kind]string = map[reflect.Kind]string{
-    reflect.Bool: "integer",
-    reflect.Int: "integer",
-    reflect.Int8: "integer",
-    reflect.Int16: "integer",
-    reflect.Int32: "integer",
-    reflect.Int64: "integer",
-    reflect.Uint: "integer",
-    reflect.Uint8: "integer",
-    reflect.Uint16: "integer",
-    reflect.Uint32: "integer",
-    reflect.Uint64: "integer",
-    reflect.Float32: "real",
-    reflect.Float64: "real",
+// Stores records, each struct type in a table of its own. Stores are safe
+// for use by concurrent goroutines.
+type Store interface {
+    Records
+    // Call fn with a transaction, committed if fn returns nil and rolled
+    // back otherwise. fn must use tx rather than the store, which may be
+    // locked until the transaction ends.
+    WithTx(ctx context.Context, fn func (tx Records) error) error
+    // Delete the table of r's type, and all of its records.
+    DropTable(ctx context.Context, r interface{}) error
+    // Execute a raw SQL statement, for maintenance tasks the record
+    // functions can't express.
+    Exec(ctx context.Context, query string, args ...interface{}) error
+    // Apply pending migrations (see Migrate).
+    Migrate(ctx context.Context, dryRun bool) ([]Migration, error)
+    // Check that the store can be reached.
+    Ping(ctx context.Context) error
+    // Write a consistent copy of the database, while it remains in use, to
+    // a new database file at path. Only SQLite stores can be backed up.
+    Backup(ctx context.Context, path string) error
+    Close() error
 }
 
-// Initialize the persistence sqlite database.
-func Init(dbPath string) error {
-    tableSet = make(map[string]reflect.Type)
+var ErrUnsupported = errors.New("not supported by this store")
+var ErrNotFound = errors.New("record not found")
+var ErrDuplicate = errors.New("duplicate record")
+
+// The store used by the package functions.
+var store Store
+
+// Open the store described by dsn without migrating it, and use it for the
+// package functions. dsn is a PostgreSQL URL (postgres://...), "memory:"
+// for a store that keeps records in memory only, or the path of an SQLite
+// database file.
+func Open(dsn string) error {
     var err error
 
-    db, err = sql.Open("sqlite3", dbPath)
+    switch {
+    case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+        store, err = NewPostgresStore(dsn)
+    case dsn == "memory:":
+        store = NewMemoryStore()
+    default:
+        store, err = NewSQLiteStore(strings.TrimPrefix(dsn, "sqlite3:"))
+    }
 
     return err
 }
 
-func getTypeName(i interface{}) string {
-    typeName := fmt.Sprintf("%T", i)
-    if typeName[0] == '*' {
-        typeName = typeName[1:]
+// Open the store described by dsn (see Open) and apply any pending
+// migrations.
+func Init(dsn string) error {
+    if err := Open(dsn); err != nil {
+        return err
     }
 
-    return typeName
+    _, err := Migrate(false)
+
+    return err
 }
 
-func getTableName(i interface{}) string {
-    return strings.ReplaceAll(getTypeName(i), ".", "_")
+// Use s for the package functions.
+func Use(s Store) {
+    store = s
+}
+
+// The store used by the package functions, whose methods take a context
+// where the package functions use context.Background().
+func Current() Store {
+    return store
 }
 
-func getFieldMap(i interface{}) (fields map[string]interface{}) {
-    fields = make(map[string]interface{})
+func Insert(r interface{}) error {
+    return store.Insert(context.Background(), r)
+}
 
-    iType := reflect.TypeOf(i).Elem()
-    iValue := reflect.ValueOf(i).Elem()
-    for i := 0; i < iType.NumField(); i++ {
-        fields[iType.Field(i).Name] = iValue.Field(i).Interface()
-    }
+func Find(r interface{}) error {
+    return store.Find(context.Background(), r)
+}
 
-    return fields
+func FindAll(r interface{}, records interface{}) error {
+    return store.FindAll(context.Background(), r, records)
 }
 
-func getFieldArray(i interface{}) (fields []interface{}) {
-    iValue := reflect.ValueOf(i).Elem()
-    fields = make([]interface{}, iValue.NumField())
-    for i := 0; i < len(fields); i++ {
-        fields[i] = iValue.Field(i).Interface()
-    }
+func FindRange(r interface{}, rng Range, records interface{}) error {
+    return store.FindRange(context.Background(), r, rng, records)
+}
 
-    return fields
+func Update(r interface{}) error {
+    return store.Update(context.Background(), r)
 }
 
-func getTableColumns(tableName string) map[string]interface{} {
-    rows, err := db.Query(fmt.Sprintf("pragma table_info(%s)", tableName))
-    if err != nil {
-        log.Fatal(err)
-    }
+func Upsert(r interface{}) error {
+    return store.Upsert(context.Background(), r)
+}
 
-    defer rows.Close()
+func Delete(r interface{}) error {
+    return store.Delete(context.Background(), r)
+}
 
-    columns := make(map[string]interface{})
+func DeleteRange(r interface{}, rng Range) (int64, error) {
+    return store.DeleteRange(context.Background(), r, rng)
+}
 
-    for rows.Next() {
-        var cid string
-        var name string
-        var coltype string
-        var notnull string
-        var dflt_value string
-        var pk string
+func DropTable(r interface{}) error {
+    return store.DropTable(context.Background(), r)
+}
 
-        rows.Scan(&cid, &name, &coltype, &notnull, &dflt_value, &pk)
-        columns[name] = coltype
-    }
+func Exec(query string, args ...interface{}) error {
+    return store.Exec(context.Background(), query, args...)
+}
 
-    return columns
+// Call fn with a transaction of the current store (see Store.WithTx).
+func WithTx(ctx context.Context, fn func (tx Records) error) error {
+    return store.WithTx(ctx, fn)
 }
 
-func makeFieldDec(field reflect.StructField) string {
-    sql := strings.Builder{}
+// Apply pending migrations, each in its own transaction, returning those
+// applied. A dry run applies them all in one transaction which is then
+// rolled back, returning those that would have been applied.
+func Migrate(dryRun bool) ([]Migration, error) {
+    return store.Migrate(context.Background(), dryRun)
+}
 
-    sql.WriteString(field.Name)
+func Backup(path string) error {
+    return store.Backup(context.Background(), path)
+}
 
-    if sqliteType, ok := goToSqliteKindMap[field.Type.Kind()]; ok {
-        sql.WriteString(" " + sqliteType)
-    } else {
-        sql.WriteString(" string")
+// Check that the database can be reached.
+func Ping() error {
+    if store == nil {
+        return errors.New("database not initialized")
     }
 
-    if field.Tag.Get("db-pk") == "true" {
-        sql.WriteString(" primary key")
+    return store.Ping(context.Background())
+}
+
+func getTypeName(i interface{}) string {
+    typeName := fmt.Sprintf("%T", i)
+    if typeName[0] == '*' {
+        typeName = typeName[1:]
     }
 
-    return sql.String()
+    return typeName
 }
 
-func createTable(r interface{}) error {
-    tableName := getTableName(r)
+func getTableName(i interface{}) string {
+    return strings.ReplaceAll(getTypeName(i), ".", "_")
+}
 
-    sql := strings.Builder{}
-    sql.WriteString("create table ")
-    sql.WriteString(tableName)
-    sql.WriteString(" (")
+// Return the name of the table records of r's type are stored in.
+func TableName(r interface{}) string {
+    return getTableName(r)
+}
 
-    rType := reflect.TypeOf(r).Elem()
-    for i := 0; i < rType.NumField(); i++ {
-        if i > 0 {
-            sql.WriteString(", ")
-        }
+// Column types, translated to each database's own by its dialect.
+var goToSqlKindMap map[reflect.Kind]string = map[reflect.Kind]string{
+    reflect.Bool: "boolean",
+    reflect.Int: "integer",
+    reflect.Int8: "integer",
+    reflect.Int16: "integer",
+    reflect.Int32: "integer",
+    reflect.Int64: "integer",
+    reflect.Uint: "integer",
+    reflect.Uint8: "integer",
+    reflect.Uint16: "integer",
+    reflect.Uint32: "integer",
+    reflect.Uint64: "integer",
+    reflect.Float32: "real",
+    reflect.Float64: "real",
+    reflect.String: "text",
+}
 
-        field := rType.Field(i)
-        sql.WriteString(makeFieldDec(field))
-    }
+var timeType = reflect.TypeOf(time.Time{})
+var bytesType = reflect.TypeOf([]byte{})
 
-    sql.WriteString(")")
+// How a field's value is stored.
+type encoding int
 
-    _, err := db.Exec(sql.String())
+const (
+    encodePlain encoding = iota
+    encodeTime
+    encodeBlob
+    encodeJSON
+)
 
-    return err
+// A column mapped from a struct field. Field tags:
+//   db-pk:"true"        primary key
+//   db-column:"name"    column name, in place of the field name
+//   db-unique:"true"    unique index
+//   db-index:"true"     index
+//   db-notnull:"true"   not null
+//   db-default:"value"  default, an SQL literal
+//   db-ignore:"true"    not stored
+// time.Time is stored as a datetime, []byte as a blob, and other structs,
+// maps, slices and pointers as JSON text.
+type column struct {
+    field int
+    name string
+    sqlType string
+    encoding encoding
+    pk bool
+    unique bool
+    index bool
+    notnull bool
+    defaultValue string
 }
 
-func verifyTable(r interface{}) (err error) {
-    tableName := getTableName(r)
+var columnsMutex sync.RWMutex
+var columnsCache = map[reflect.Type][]column{}
+
+func makeColumn(index int, field reflect.StructField) column {
+    col := column{
+        field: index,
+        name: field.Name,
+        pk: field.Tag.Get("db-pk") == "true",
+        unique: field.Tag.Get("db-unique") == "true",
+        index: field.Tag.Get("db-index") == "true",
+        notnull: field.Tag.Get("db-notnull") == "true",
+        defaultValue: field.Tag.Get("db-default"),
+    }
 
-    if _, ok := tableSet[tableName]; ok {
-        return nil
+    if name := field.Tag.Get("db-column"); name != "" {
+        col.name = name
     }
-    defer func () {tableSet[tableName] = reflect.TypeOf(r)}()
 
-    log.Printf("verifying table %s", tableName)
+    switch {
+    case field.Type == timeType:
+        col.sqlType = "datetime"
+        col.encoding = encodeTime
+    case field.Type == bytesType:
+        col.sqlType = "blob"
+        col.encoding = encodeBlob
+    default:
+        if sqlType, ok := goToSqlKindMap[field.Type.Kind()]; ok {
+            col.sqlType = sqlType
+        } else {
+            col.sqlType = "text"
+            col.encoding = encodeJSON
+        }
+    }
 
-    columns := getTableColumns(tableName)
+    return col
+}
 
-    if len(columns) <= 0 {
-        createTable(r)
+// The columns of r's table, in struct field order.
+func getColumns(r interface{}) []column {
+    rType := reflect.TypeOf(r).Elem()
 
-        return nil
+    columnsMutex.RLock()
+    columns, ok := columnsCache[rType]
+    columnsMutex.RUnlock()
+    if ok {
+        return columns
     }
 
-    rType := reflect.TypeOf(r).Elem()
-    sql := strings.Builder{}
-
+    columns = []column{}
     for i := 0; i < rType.NumField(); i++ {
         field := rType.Field(i)
-        if _, ok := columns[field.Name]; !ok {
-            sql.WriteString(fmt.Sprintf("alter table %s add column %s",
-                    tableName, makeFieldDec(field)))
+        if field.PkgPath != "" || field.Tag.Get("db-ignore") == "true" {
+            continue
         }
-    }
 
-    if sql.Len() > 0 {
-        _, err = db.Exec(sql.String())
+        columns = append(columns, makeColumn(i, field))
     }
 
-    return err
-}
+    columnsMutex.Lock()
+    columnsCache[rType] = columns
+    columnsMutex.Unlock()
 
-// Insert a new record into the store.
-var insertSqlCache map[string]string = map[string]string{}
+    return columns
+}
 
-func Insert(r interface{}) (err error) {
-    if err = verifyTable(r); err != nil {
-        return err
+// The index among r's columns of its primary key, tagged db-pk.
+func primaryKeyIndex(r interface{}) (int, error) {
+    for i, col := range getColumns(r) {
+        if col.pk {
+            return i, nil
+        }
     }
 
-    tableName := getTableName(r)
+    return 0, errors.New(fmt.Sprintf("%s has no db-pk field", getTypeName(r)))
+}
 
-    if _, ok := insertSqlCache[tableName]; !ok {
-        sql := strings.Builder{}
-        rType := reflect.TypeOf(r).Elem()
+// The value stored for a field.
+func (col *column) encode(value reflect.Value) (interface{}, error) {
+    switch col.encoding {
+    case encodeTime:
+        return value.Interface().(time.Time).UTC(), nil
+    case encodeJSON:
+        data, err := json.Marshal(value.Interface())
+        if err != nil {
+            return nil, fmt.Errorf("column %s: %w", col.name, err)
+        }
 
-        sql.WriteString(fmt.Sprintf("insert into %s (", tableName))
-        for i:= 0; i < rType.NumField(); i++ {
-            if i > 0 {
-                sql.WriteString(", ")
-            }
+        return string(data), nil
+    default:
+        return value.Interface(), nil
+    }
+}
 
-            sql.WriteString(rType.Field(i).Name)
+// Stored field values in struct field order.
+func getFieldArray(i interface{}) (fields []interface{}, err error) {
+    iValue := reflect.ValueOf(i).Elem()
+    for _, col := range getColumns(i) {
+        value, err := col.encode(iValue.Field(col.field))
+        if err != nil {
+            return nil, err
         }
 
-        sql.WriteString(") values (?")
-        sql.WriteString(strings.Repeat(", ?", rType.NumField()-1))
-        sql.WriteString(")")
-
-        insertSqlCache[tableName] = sql.String()
+        fields = append(fields, value)
     }
 
-    tx, err := db.Begin()
-    if err != nil {
-        return err
-    }
+    return fields, nil
+}
 
-    stmt, err := tx.Prepare(insertSqlCache[tableName])
-    if err != nil {
-        return err
+// Check that records is a pointer to a slice of r's type.
+func checkRecords(r interface{}, records interface{}) (reflect.Value, error) {
+    recordsValue := reflect.ValueOf(records)
+    if recordsValue.Kind() != reflect.Ptr || recordsValue.Elem().Kind() != reflect.Slice ||
+            recordsValue.Elem().Type().Elem() != reflect.TypeOf(r).Elem() {
+        return recordsValue, errors.New(fmt.Sprintf("FindAll: records must be a *[]%s, not %T",
+                getTypeName(r), records))
     }
-    defer stmt.Close()
 
-    _, err = stmt.Exec(getFieldArray(r)...)
-    if err != nil {
-        tx.Rollback()
-        return err
+    return recordsValue, nil
+}
+
+// The index among r's columns of the field rng bounds and orders by (-1 for
+// none), and its bounds as stored (nil for none).
+func (rng *Range) bounds(r interface{}) (int, interface{}, interface{}, error) {
+    if rng.Field == "" {
+        return -1, nil, nil, nil
     }
 
-    tx.Commit()
+    for c, col := range getColumns(r) {
+        if reflect.TypeOf(r).Elem().Field(col.field).Name != rng.Field {
+            continue
+        }
 
-    return nil
-}
+        bounds := []interface{}{rng.From, rng.Before}
+        for i, bound := range bounds {
+            if bound == nil {
+                continue
+            }
 
-// !!!FUTURE!!! wsm - the way the sql module is structured makes it
-// *very* difficult to retrieve row data parametrically (see the
-// https://pkg.go.dev/database/sql#Rows.Scan Scan() function). In
-// the future it would be nice to be able to auto-populate the
-// structure and return it, but sadly for now a callback it is.
-func Find(r interface{}, populate scanner) (err error) {
-    if err = verifyTable(r); err != nil {
-        return err
+            value, err := col.encode(reflect.ValueOf(bound))
+            if err != nil {
+                return 0, nil, nil, err
+            }
+            bounds[i] = value
+        }
+
+        return c, bounds[0], bounds[1], nil
     }
 
-    tableName := getTableName(r)
-    fields := getFieldMap(r)
-    columns := strings.Builder{}
-    where := strings.Builder{}
-    whereValues := make([]interface{}, 0, len(fields))
+    return 0, nil, nil, errors.New(fmt.Sprintf("%s has no stored field %s", getTypeName(r), rng.Field))
+}
+
+// Scans a column into a struct field, converting from the types sqlite
+// returns and leaving the field zero for NULL (as in columns added to a
+// table after its rows were inserted).
+type fieldScanner struct {
+    field reflect.Value
+    encoding encoding
+}
 
-    for field, value := range fields {
-        if columns.Len() > 0 {
-            columns.WriteString(", ")
-        }
-        columns.WriteString(field)
+// Layouts of times stored as text, as written by the sqlite driver.
+var timeLayouts = []string{
+    "2006-01-02 15:04:05.999999999-07:00",
+    "2006-01-02T15:04:05.999999999-07:00",
+    "2006-01-02 15:04:05.999999999",
+    "2006-01-02T15:04:05.999999999",
+    "2006-01-02",
+}
 
-        if !reflect.ValueOf(value).IsZero() {
-            if where.Len() > 0 {
-                where.WriteString(" and ")
+func (s fieldScanner) scanTime(src interface{}) error {
+    switch v := src.(type) {
+    case time.Time:
+        s.field.Set(reflect.ValueOf(v))
+    case int64:
+        s.field.Set(reflect.ValueOf(time.Unix(v, 0).UTC()))
+    case string, []byte:
+        text := strings.TrimSuffix(fmt.Sprintf("%s", v), "Z")
+        for _, layout := range timeLayouts {
+            if t, err := time.Parse(layout, text); err == nil {
+                s.field.Set(reflect.ValueOf(t.UTC()))
+
+                return nil
             }
-            where.WriteString(fmt.Sprintf("%s = ?", field))
-            whereValues = append(whereValues, value)
         }
+
+        return errors.New(fmt.Sprintf("unable to parse time '%s'", text))
+    default:
+        return errors.New(fmt.Sprintf("unable to scan %T into time.Time", src))
     }
 
-    sql := strings.Builder{}
-    sql.WriteString(fmt.Sprintf("select %s from %s", columns.String(),
-            tableName))
+    return nil
+}
 
-    if where.Len() > 0 {
-        sql.WriteString(" where " + where.String())
+func (s fieldScanner) Scan(src interface{}) error {
+    s.field.Set(reflect.Zero(s.field.Type()))
+    if src == nil {
+        return nil
     }
 
-    stmt, err := db.Prepare(sql.String())
-    if err != nil {
-        return err
-    }
-    defer stmt.Close()
+    switch s.encoding {
+    case encodeTime:
+        return s.scanTime(src)
+    case encodeBlob:
+        switch v := src.(type) {
+        case []byte:
+            s.field.SetBytes(append([]byte{}, v...))
+        case string:
+            s.field.SetBytes([]byte(v))
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into []byte", src))
+        }
 
-    rows, err := stmt.Query(whereValues...)
-    if err != nil {
-        return err
+        return nil
+    case encodeJSON:
+        switch v := src.(type) {
+        case []byte:
+            return json.Unmarshal(v, s.field.Addr().Interface())
+        case string:
+            return json.Unmarshal([]byte(v), s.field.Addr().Interface())
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into %s", src, s.field.Type()))
+        }
     }
-    defer rows.Close()
 
-    if !rows.Next() {
-        return errors.New("record not found")
+    switch s.field.Kind() {
+    case reflect.String:
+        switch v := src.(type) {
+        case string:
+            s.field.SetString(v)
+        case []byte:
+            s.field.SetString(string(v))
+        default:
+            s.field.SetString(fmt.Sprint(v))
+        }
+    case reflect.Bool:
+        switch v := src.(type) {
+        case bool:
+            s.field.SetBool(v)
+        case int64:
+            s.field.SetBool(v != 0)
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into bool", src))
+        }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        switch v := src.(type) {
+        case int64:
+            s.field.SetInt(v)
+        case float64:
+            s.field.SetInt(int64(v))
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into %s", src, s.field.Type()))
+        }
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        switch v := src.(type) {
+        case int64:
+            s.field.SetUint(uint64(v))
+        case float64:
+            s.field.SetUint(uint64(v))
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into %s", src, s.field.Type()))
+        }
+    case reflect.Float32, reflect.Float64:
+        switch v := src.(type) {
+        case float64:
+            s.field.SetFloat(v)
+        case int64:
+            s.field.SetFloat(float64(v))
+        default:
+            return errors.New(fmt.Sprintf("unable to scan %T into %s", src, s.field.Type()))
+        }
+    default:
+        return errors.New(fmt.Sprintf("unable to scan into field of type %s", s.field.Type()))
     }
 
-    if err != nil {
-        return err
+    return nil
+}
+
+// A schema or data change. UpRecords, if set, runs in place of Up and SQL,
+// with record operations in the migration's transaction; Up, if set, runs
+// in place of SQL. Each runs in a transaction that also records the
+// migration as applied. Stores that don't use SQL have nothing to migrate.
+type Migration struct {
+    Version int
+    Name string
+    // if set, the only SQL driver ("sqlite3" or "postgres") the migration
+    // applies to; other databases record it as applied without running it
+    Dialect string
+    // records whose tables the migration needs, created or widened first
+    Records []interface{}
+    SQL string
+    Up func (tx *sql.Tx) error
+    UpRecords func (ctx context.Context, tx Records) error
+}
+
+var migrations = map[int]Migration{}
+
+const migrationsTable = "schema_migrations"
+
+// Register a migration to be applied, in version order, by Init.
+func RegisterMigration(migration Migration) {
+    if _, ok := migrations[migration.Version]; ok {
+        panic(fmt.Sprintf("persist: migration %d registered twice", migration.Version))
     }
 
-    populate(rows)
+    migrations[migration.Version] = migration
+}
 
-    return nil
+// The registered migrations not in applied, in version order.
+func pendingMigrations(applied map[int]bool) []Migration {
+    pending := []Migration{}
+    for version, migration := range migrations {
+        if !applied[version] {
+            pending = append(pending, migration)
+        }
+    }
+    sort.Slice(pending, func (i, j int) bool {
+        return pending[i].Version < pending[j].Version
+    })
+
+    return pending
 }
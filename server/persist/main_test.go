@@ -0,0 +1,761 @@
+package persist
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+type Record struct {
+    ID string `db-pk:"true"`
+    Kind string
+    Count int64
+    Ratio float64
+    Enabled bool
+}
+
+// Added to Record's table after rows were inserted without it.
+type Widened struct {
+    ID string `db-pk:"true"`
+    Name string
+    Size int64
+}
+
+type Legacy struct {
+    ID string `db-pk:"true"`
+    Code string
+    Count int64
+}
+
+type Migrated struct {
+    ID string `db-pk:"true"`
+    Kind string
+}
+
+type NoKey struct {
+    Name string
+}
+
+type Narrow struct {
+    ID string `db-pk:"true"`
+    Name string
+}
+
+var sqliteStore Store
+var postgresStore Store
+
+// Tests run against a scratch SQLite database, and those for every store
+// against memory and, if MUTEX_TEST_POSTGRES_DSN is set, the PostgreSQL
+// database it names too.
+func TestMain(m *testing.M) {
+    dbDir, err := ioutil.TempDir("", "persist-test")
+    if err != nil {
+        panic(err)
+    }
+
+    if err = Init(filepath.Join(dbDir, "persist_test.db")); err != nil {
+        panic(err)
+    }
+    sqliteStore = Current()
+
+    if dsn := os.Getenv("MUTEX_TEST_POSTGRES_DSN"); dsn != "" {
+        if postgresStore, err = NewPostgresStore(dsn); err != nil {
+            panic(err)
+        }
+
+        for _, r := range []interface{}{&Record{}, &Ranged{}, &Tagged{}, &Transacted{}, &Concurrent{}} {
+            if err = postgresStore.DropTable(context.Background(), r); err != nil {
+                panic(err)
+            }
+        }
+    }
+
+    code := m.Run()
+
+    os.RemoveAll(dbDir)
+    os.Exit(code)
+}
+
+// Run test with each store in turn as the current store.
+func forEachStore(t *testing.T, test func (t *testing.T)) {
+    stores := map[string]Store{
+        "sqlite": sqliteStore,
+        "memory": NewMemoryStore(),
+        "postgres": postgresStore,
+    }
+    defer Use(sqliteStore)
+
+    for _, name := range []string{"sqlite", "memory", "postgres"} {
+        t.Run(name, func (t *testing.T) {
+            if stores[name] == nil {
+                t.Skip("MUTEX_TEST_POSTGRES_DSN not set")
+            }
+
+            Use(stores[name])
+            test(t)
+        })
+    }
+}
+
+func sqliteDB() *sql.DB {
+    return sqliteStore.(*sqlStore).db
+}
+
+func TestOpen(t *testing.T) {
+    defer Use(sqliteStore)
+
+    if err := Open("memory:"); err != nil {
+        t.Errorf("Open(memory:): %v", err)
+    } else if _, ok := Current().(*memoryStore); !ok {
+        t.Errorf("Open(memory:): opened %T", Current())
+    }
+
+    if err := Open("postgres://localhost/mutex"); err != nil {
+        t.Errorf("Open(postgres://...): %v", err)
+    } else if store, ok := Current().(*sqlStore); !ok || store.dialect != postgresDialect {
+        t.Errorf("Open(postgres://...): opened %T", Current())
+    }
+
+    if err := NewMemoryStore().Exec(context.Background(), "select 1"); !errors.Is(err, ErrUnsupported) {
+        t.Errorf("memory store Exec: expected ErrUnsupported: %v", err)
+    }
+
+    query := "select ? from t where a = '?' and b = ?"
+    if rebound := postgresDialect.rebind(query); rebound != "select $1 from t where a = '?' and b = $2" {
+        t.Errorf("rebind(%s): %s", query, rebound)
+    }
+}
+
+func TestFind(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        inserted := []Record{
+            {ID: "a", Kind: "odd", Count: 1, Ratio: 0.5, Enabled: true},
+            {ID: "b", Kind: "even", Count: 2},
+            {ID: "c", Kind: "odd", Count: 3, Ratio: 1.5},
+        }
+        for i := range inserted {
+            if err := Insert(&inserted[i]); err != nil {
+                t.Fatalf("Insert(%s): %v", inserted[i].ID, err)
+            }
+        }
+
+        record := Record{ID: "a"}
+        if err := Find(&record); err != nil || record != inserted[0] {
+            t.Errorf("Find(a): expected %+v: found %+v: %v", inserted[0], record, err)
+        }
+
+        record = Record{ID: "missing"}
+        if err := Find(&record); err == nil {
+            t.Errorf("Find(missing): expected an error: found %+v", record)
+        }
+
+        records := []Record{}
+        if err := FindAll(&Record{Kind: "odd"}, &records); err != nil || len(records) != 2 ||
+                records[0] != inserted[0] && records[1] != inserted[0] {
+            t.Errorf("FindAll(odd): expected a and c: found %+v: %v", records, err)
+        }
+
+        records = []Record{}
+        if err := FindAll(&Record{Kind: "none"}, &records); err != nil || len(records) != 0 {
+            t.Errorf("FindAll(none): expected no records: found %+v: %v", records, err)
+        }
+
+        if err := FindAll(&Record{}, &[]Narrow{}); err == nil {
+            t.Errorf("FindAll into a slice of the wrong type: expected an error")
+        }
+    })
+}
+
+func TestFindAddedColumn(t *testing.T) {
+    if err := Insert(&Narrow{ID: "n", Name: "narrow"}); err != nil {
+        t.Fatalf("Insert(narrow): %v", err)
+    }
+
+    // read the same table through a struct with an extra column
+    if err := Exec("alter table persist_Narrow rename to persist_Widened"); err != nil {
+        t.Fatalf("rename: %v", err)
+    }
+
+    widened := Widened{ID: "n"}
+    if err := Find(&widened); err != nil || widened.Name != "narrow" || widened.Size != 0 {
+        t.Errorf("Find with a column added: found %+v: %v", widened, err)
+    }
+}
+
+func TestUpdate(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        record := Record{ID: "u", Kind: "before", Count: 1}
+        if err := Insert(&record); err != nil {
+            t.Fatalf("Insert(u): %v", err)
+        }
+
+        record.Kind = "after"
+        record.Count = 0
+        if err := Update(&record); err != nil {
+            t.Fatalf("Update(u): %v", err)
+        }
+
+        found := Record{ID: "u"}
+        if err := Find(&found); err != nil || found != record {
+            t.Errorf("Find(u) after Update: expected %+v: found %+v: %v", record, found, err)
+        }
+
+        if err := Update(&Record{ID: "missing"}); !errors.Is(err, ErrNotFound) {
+            t.Errorf("Update(missing): expected ErrNotFound: %v", err)
+        }
+
+        if err := Update(&NoKey{Name: "x"}); err == nil {
+            t.Errorf("Update without a db-pk field: expected an error")
+        }
+    })
+}
+
+func TestUpsert(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        record := Record{ID: "v", Kind: "first", Count: 1}
+        if err := Upsert(&record); err != nil {
+            t.Fatalf("Upsert(v) inserting: %v", err)
+        }
+
+        record.Kind = "second"
+        record.Enabled = true
+        if err := Upsert(&record); err != nil {
+            t.Fatalf("Upsert(v) updating: %v", err)
+        }
+
+        records := []Record{}
+        if err := FindAll(&Record{ID: "v"}, &records); err != nil || len(records) != 1 || records[0] != record {
+            t.Errorf("FindAll(v) after Upsert: expected [%+v]: found %+v: %v", record, records, err)
+        }
+
+        if err := Insert(&record); !errors.Is(err, ErrDuplicate) {
+            t.Errorf("Insert(v) after Upsert: expected ErrDuplicate: %v", err)
+        }
+    })
+}
+
+func TestDelete(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        record := Record{ID: "d", Kind: "doomed"}
+        if err := Insert(&record); err != nil {
+            t.Fatalf("Insert(d): %v", err)
+        }
+
+        if err := Delete(&Record{ID: "d"}); err != nil {
+            t.Fatalf("Delete(d): %v", err)
+        }
+
+        if err := Find(&Record{ID: "d"}); !errors.Is(err, ErrNotFound) {
+            t.Errorf("Find(d) after Delete: expected ErrNotFound: %v", err)
+        }
+
+        if err := Delete(&Record{ID: "d"}); err != nil {
+            t.Errorf("Delete(d) again: %v", err)
+        }
+    })
+}
+
+func TestStatementCache(t *testing.T) {
+    ctx := context.Background()
+    store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "statements.db"))
+    if err != nil {
+        t.Fatalf("NewSQLiteStore: %v", err)
+    }
+    s := store.(*sqlStore)
+
+    cached := func () *sql.Stmt {
+        s.mu.RLock()
+        defer s.mu.RUnlock()
+
+        return s.stmtCache["insert " + getTableName(&Record{})]
+    }
+
+    // a statement isn't prepared within the transaction creating its table
+    if err = store.WithTx(ctx, func (tx Records) error {
+        return tx.Insert(ctx, &Record{ID: "s1"})
+    }); err != nil || cached() != nil {
+        t.Fatalf("Insert(s1) in a transaction: cached %v: %v", cached(), err)
+    }
+
+    if err = store.Insert(ctx, &Record{ID: "s2"}); err != nil || cached() == nil {
+        t.Fatalf("Insert(s2): expected a prepared statement: %v", err)
+    }
+    stmt := cached()
+
+    if err = store.WithTx(ctx, func (tx Records) error {
+        return tx.Insert(ctx, &Record{ID: "s3"})
+    }); err != nil || cached() != stmt {
+        t.Errorf("Insert(s3) in a transaction: expected the prepared statement: %v", err)
+    }
+
+    if err = store.DropTable(ctx, &Record{}); err != nil || cached() != nil {
+        t.Errorf("DropTable: expected its statements forgotten: %v", err)
+    }
+
+    if err = store.Insert(ctx, &Record{ID: "s4"}); err != nil {
+        t.Errorf("Insert(s4) after DropTable: %v", err)
+    }
+
+    if err = store.Close(); err != nil || cached() != nil {
+        t.Errorf("Close: expected its statements closed: %v", err)
+    }
+}
+
+type Ranged struct {
+    ID string `db-pk:"true"`
+    Kind string
+    Time int64
+}
+
+func TestFindRange(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        for i := 1; i <= 5; i++ {
+            if err := Insert(&Ranged{ID: fmt.Sprint("a", i), Kind: "a", Time: int64(i)}); err != nil {
+                t.Fatalf("Insert(a%d): %v", i, err)
+            }
+        }
+        Insert(&Ranged{ID: "b3", Kind: "b", Time: 3})
+        Insert(&Ranged{ID: "a0", Kind: "a", Time: 3})
+
+        times := func (records []Ranged) string {
+            found := ""
+            for _, record := range records {
+                found += fmt.Sprint(record.Time)
+            }
+
+            return found
+        }
+
+        newest := []Ranged{}
+        rng := Range{Field: "Time", From: 2, Descending: true, Limit: 2}
+        if err := FindRange(&Ranged{Kind: "a"}, rng, &newest); err != nil || times(newest) != "54" {
+            t.Errorf("FindRange(%+v): expected times 5, 4: found %v: %v", rng, newest, err)
+        }
+
+        bounded := []Ranged{}
+        rng = Range{Field: "Time", From: 2, Before: 4}
+        if err := FindRange(&Ranged{}, rng, &bounded); err != nil || len(bounded) != 4 ||
+                bounded[0].Time != 2 || bounded[1].ID != "a0" || bounded[2].ID != "a3" || bounded[3].ID != "b3" {
+            t.Errorf("FindRange(%+v): expected a2, then a0, a3 and b3 by ID: found %v: %v", rng, bounded, err)
+        }
+
+        if err := FindRange(&Ranged{}, Range{Field: "Missing"}, &bounded); err == nil {
+            t.Errorf("FindRange by a missing field: expected an error")
+        }
+
+        deleted, err := DeleteRange(&Ranged{Kind: "a"}, Range{Field: "Time", Before: 4})
+        if err != nil || deleted != 4 {
+            t.Errorf("DeleteRange(Time < 4): expected 4 deleted: deleted %d: %v", deleted, err)
+        }
+
+        remaining := []Ranged{}
+        FindRange(&Ranged{}, Range{Field: "Time"}, &remaining)
+        if times(remaining) != "345" {
+            t.Errorf("after DeleteRange: expected times 3, 4, 5: found %v", remaining)
+        }
+
+        DeleteRange(&Ranged{}, Range{})
+    })
+}
+
+type Transacted struct {
+    ID string `db-pk:"true"`
+    Name string `db-unique:"true"`
+}
+
+func countTransacted(t *testing.T) int {
+    records := []Transacted{}
+    if err := FindAll(&Transacted{}, &records); err != nil {
+        t.Fatalf("FindAll: %v", err)
+    }
+
+    return len(records)
+}
+
+func TestWithTx(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        ctx := context.Background()
+        failed := errors.New("failed")
+
+        // the table is first created within a transaction that rolls back
+        err := WithTx(ctx, func (tx Records) error {
+            if err := tx.Insert(ctx, &Transacted{ID: "a", Name: "a"}); err != nil {
+                return err
+            }
+            return failed
+        })
+        if err != failed {
+            t.Fatalf("WithTx returning an error: %v", err)
+        }
+        if err = Find(&Transacted{ID: "a"}); !errors.Is(err, ErrNotFound) {
+            t.Errorf("Find(a) after rollback: expected ErrNotFound: %v", err)
+        }
+
+        err = WithTx(ctx, func (tx Records) error {
+            if err := tx.Insert(ctx, &Transacted{ID: "a", Name: "a"}); err != nil {
+                return err
+            }
+
+            found := Transacted{ID: "a"}
+            if err := tx.Find(ctx, &found); err != nil || found.Name != "a" {
+                return fmt.Errorf("Find(a) in transaction: found %+v: %v", found, err)
+            }
+
+            return tx.Insert(ctx, &Transacted{ID: "b", Name: "b"})
+        })
+        if err != nil {
+            t.Fatalf("WithTx committing: %v", err)
+        }
+        if count := countTransacted(t); count != 2 {
+            t.Errorf("after commit: expected 2 records: found %d", count)
+        }
+
+        err = WithTx(ctx, func (tx Records) error {
+            if err := tx.Delete(ctx, &Transacted{ID: "a"}); err != nil {
+                return err
+            }
+            return tx.Insert(ctx, &Transacted{ID: "c", Name: "b"})
+        })
+        if !errors.Is(err, ErrDuplicate) {
+            t.Errorf("WithTx inserting a duplicate: expected ErrDuplicate: %v", err)
+        }
+        if count := countTransacted(t); count != 2 {
+            t.Errorf("after a duplicate: expected 2 records: found %d", count)
+        }
+
+        canceled, cancel := context.WithCancel(ctx)
+        cancel()
+        err = WithTx(canceled, func (tx Records) error {
+            return tx.Delete(canceled, &Transacted{ID: "a"})
+        })
+        if err == nil {
+            t.Errorf("WithTx with a canceled context: expected an error")
+        }
+        if err = Current().Find(canceled, &Transacted{ID: "a"}); err == nil {
+            t.Errorf("Find with a canceled context: expected an error")
+        }
+        if count := countTransacted(t); count != 2 {
+            t.Errorf("after cancellation: expected 2 records: found %d", count)
+        }
+    })
+}
+
+type Concurrent struct {
+    ID string `db-pk:"true"`
+    Writer int
+}
+
+func TestConcurrent(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        const writers = 8
+        const records = 10
+
+        wg := sync.WaitGroup{}
+        errs := make(chan error, writers * records)
+        for w := 0; w < writers; w++ {
+            wg.Add(1)
+            go func (w int) {
+                defer wg.Done()
+                for i := 0; i < records; i++ {
+                    if err := Insert(&Concurrent{ID: fmt.Sprintf("%d-%d", w, i), Writer: w}); err != nil {
+                        errs <- err
+                    }
+                    if err := FindAll(&Concurrent{Writer: w}, &[]Concurrent{}); err != nil {
+                        errs <- err
+                    }
+                }
+            }(w)
+        }
+        wg.Wait()
+        close(errs)
+
+        for err := range errs {
+            t.Errorf("concurrent Insert or FindAll: %v", err)
+        }
+
+        found := []Concurrent{}
+        if err := FindAll(&Concurrent{}, &found); err != nil || len(found) != writers * records {
+            t.Errorf("FindAll: expected %d records: found %d: %v", writers * records, len(found), err)
+        }
+    })
+}
+
+type Grown struct {
+    ID string `db-pk:"true"`
+}
+
+// Grown with two more columns.
+type Grown2 struct {
+    ID string `db-pk:"true"`
+    Name string
+    Size int64
+}
+
+func TestAddColumns(t *testing.T) {
+    if err := Insert(&Grown{ID: "g"}); err != nil {
+        t.Fatalf("Insert(g): %v", err)
+    }
+
+    if err := Exec("alter table persist_Grown rename to persist_Grown2"); err != nil {
+        t.Fatalf("rename: %v", err)
+    }
+
+    grown := Grown2{ID: "h", Name: "grown", Size: 2}
+    if err := Insert(&grown); err != nil {
+        t.Fatalf("Insert with two columns added: %v", err)
+    }
+
+    found := Grown2{ID: "h"}
+    if err := Find(&found); err != nil || found != grown {
+        t.Errorf("Find(h): expected %+v: found %+v: %v", grown, found, err)
+    }
+}
+
+func countRows(t *testing.T, query string) (count int) {
+    if err := sqliteDB().QueryRow(query).Scan(&count); err != nil {
+        t.Fatalf("%s: %v", query, err)
+    }
+
+    return count
+}
+
+func TestMigrate(t *testing.T) {
+    RegisterMigration(Migration{
+        Version: 1,
+        Name: "index records by kind",
+        Records: []interface{}{&Migrated{}},
+        SQL: "create index persist_Migrated_Kind on persist_Migrated (Kind)",
+    })
+    RegisterMigration(Migration{
+        Version: 2,
+        Name: "backfill kinds",
+        Records: []interface{}{&Migrated{}},
+        Up: func (tx *sql.Tx) error {
+            _, err := tx.Exec("insert into persist_Migrated (ID, Kind) values ('m', 'migrated')")
+            return err
+        },
+    })
+
+    pending, err := Migrate(true)
+    if err != nil || len(pending) != 2 || pending[0].Version != 1 || pending[1].Version != 2 {
+        t.Fatalf("Migrate(dry run): expected migrations 1 and 2: received %+v: %v", pending, err)
+    }
+
+    if applied := countRows(t, "select count(*) from schema_migrations"); applied != 0 {
+        t.Errorf("Migrate(dry run): %d migrations recorded as applied", applied)
+    }
+    if tables := countRows(t, "select count(*) from sqlite_master where name = 'persist_Migrated'"); tables != 0 {
+        t.Errorf("Migrate(dry run): table created")
+    }
+
+    if pending, err = Migrate(false); err != nil || len(pending) != 2 {
+        t.Fatalf("Migrate: expected 2 migrations applied: received %+v: %v", pending, err)
+    }
+
+    migrated := Migrated{ID: "m"}
+    if err := Find(&migrated); err != nil || migrated.Kind != "migrated" {
+        t.Errorf("Find(m) after Migrate: found %+v: %v", migrated, err)
+    }
+    if indexes := countRows(t, "select count(*) from sqlite_master where name = 'persist_Migrated_Kind'"); indexes != 1 {
+        t.Errorf("Migrate: index not created")
+    }
+
+    if pending, err = Migrate(false); err != nil || len(pending) != 0 {
+        t.Errorf("Migrate again: expected nothing to apply: received %+v: %v", pending, err)
+    }
+
+    // a failing migration is rolled back and not recorded
+    RegisterMigration(Migration{
+        Version: 3,
+        Name: "fail",
+        SQL: "insert into persist_Migrated (ID, Kind) values ('f', 'failed'); select * from missing_table",
+    })
+
+    if pending, err = Migrate(false); err == nil || len(pending) != 0 {
+        t.Errorf("Migrate with a failing migration: expected an error: received %+v: %v", pending, err)
+    }
+    if err := Find(&Migrated{ID: "f"}); err == nil {
+        t.Errorf("failed migration not rolled back")
+    }
+    if pending, err := sqliteStore.(*sqlStore).pendingMigrations(context.Background()); err != nil || len(pending) != 1 || pending[0].Version != 3 {
+        t.Errorf("pendingMigrations: expected migration 3: received %+v: %v", pending, err)
+    }
+    delete(migrations, 3)
+
+    // record operations run in the migration's transaction
+    RegisterMigration(Migration{
+        Version: 3,
+        Name: "insert a record",
+        UpRecords: func (ctx context.Context, tx Records) error {
+            return tx.Insert(ctx, &Migrated{ID: "r", Kind: "recorded"})
+        },
+    })
+    defer delete(migrations, 3)
+
+    if pending, err = Migrate(false); err != nil || len(pending) != 1 {
+        t.Fatalf("Migrate with UpRecords: expected 1 migration applied: received %+v: %v", pending, err)
+    }
+    migrated = Migrated{ID: "r"}
+    if err := Find(&migrated); err != nil || migrated.Kind != "recorded" {
+        t.Errorf("Find(r) after Migrate: found %+v: %v", migrated, err)
+    }
+}
+
+type Nested struct {
+    Limit int
+    Tags []string
+}
+
+type Tagged struct {
+    ID string `db-pk:"true"`
+    Name string `db-column:"Label" db-unique:"true"`
+    Count int64 `db-notnull:"true" db-default:"7"`
+    When time.Time `db-index:"true"`
+    Nested Nested
+    Meta map[string]int
+    Data []byte
+    Skipped string `db-ignore:"true"`
+    unexported int
+}
+
+func TestTags(t *testing.T) {
+    forEachStore(t, func (t *testing.T) {
+        when := time.Date(2024, 6, 1, 12, 30, 15, 500, time.FixedZone("X", 3600))
+        tagged := Tagged{
+            ID: "t",
+            Name: "0123",
+            Count: 3,
+            When: when,
+            Nested: Nested{Limit: 5, Tags: []string{"a", "b"}},
+            Meta: map[string]int{"x": 1},
+            Data: []byte{0, 1, 2, 255},
+            Skipped: "skipped",
+            unexported: 1,
+        }
+        if err := Insert(&tagged); err != nil {
+            t.Fatalf("Insert(t): %v", err)
+        }
+
+        found := Tagged{ID: "t"}
+        if err := Find(&found); err != nil {
+            t.Fatalf("Find(t): %v", err)
+        }
+        if found.Name != "0123" || found.Count != 3 || !found.When.Equal(when) || found.Nested.Limit != 5 ||
+                len(found.Nested.Tags) != 2 || found.Meta["x"] != 1 || !bytes.Equal(found.Data, tagged.Data) ||
+                found.Skipped != "" || found.unexported != 0 {
+            t.Errorf("Find(t): expected %+v: found %+v", tagged, found)
+        }
+
+        found = Tagged{When: when}
+        if err := Find(&found); err != nil || found.ID != "t" {
+            t.Errorf("Find by time: found %+v: %v", found, err)
+        }
+
+        if err := Insert(&Tagged{ID: "u", Name: "0123"}); !errors.Is(err, ErrDuplicate) {
+            t.Errorf("Insert with a duplicate unique column: expected ErrDuplicate: %v", err)
+        }
+    })
+}
+
+// Constraints and indexes of tagged columns in SQL stores.
+func TestTagConstraints(t *testing.T) {
+    if err := Insert(&Tagged{ID: "c", Name: "constrained"}); err != nil {
+        t.Fatalf("Insert(c): %v", err)
+    }
+
+    if err := Exec("insert into persist_Tagged (ID, Label) values ('d', 'defaulted')"); err != nil {
+        t.Fatalf("insert without Count: %v", err)
+    }
+    found := Tagged{ID: "d"}
+    if err := Find(&found); err != nil || found.Count != 7 || !found.When.IsZero() || found.Meta != nil {
+        t.Errorf("Find(d): expected the default count: found %+v: %v", found, err)
+    }
+
+    if err := Exec("insert into persist_Tagged (ID, Label, Count) values ('n', 'null', null)"); err == nil {
+        t.Errorf("insert with a null Count: expected an error")
+    }
+
+    if countRows(t, "select count(*) from sqlite_master where name = 'persist_Tagged_When'") != 1 {
+        t.Errorf("index on When not created")
+    }
+}
+
+func TestConvertStringColumns(t *testing.T) {
+    if err := Exec("create table persist_Legacy (ID string primary key, Code string, Count integer)"); err != nil {
+        t.Fatalf("create: %v", err)
+    }
+    if err := Exec("create index persist_Legacy_Code on persist_Legacy (Code)"); err != nil {
+        t.Fatalf("create index: %v", err)
+    }
+    if err := Exec("insert into persist_Legacy values ('a', 'abc', 1)"); err != nil {
+        t.Fatalf("insert: %v", err)
+    }
+
+    tx, err := sqliteDB().Begin()
+    if err != nil {
+        t.Fatalf("begin: %v", err)
+    }
+    if err = ConvertStringColumns(tx); err != nil {
+        tx.Rollback()
+        t.Fatalf("ConvertStringColumns: %v", err)
+    }
+    if err = tx.Commit(); err != nil {
+        t.Fatalf("commit: %v", err)
+    }
+
+    if err := Insert(&Legacy{ID: "b", Code: "0123"}); err != nil {
+        t.Fatalf("Insert(b): %v", err)
+    }
+
+    records := []Legacy{}
+    if err := FindAll(&Legacy{}, &records); err != nil || len(records) != 2 {
+        t.Fatalf("FindAll: expected 2 records: found %+v: %v", records, err)
+    }
+    for _, record := range records {
+        if record.ID == "a" && (record.Code != "abc" || record.Count != 1) || record.ID == "b" && record.Code != "0123" {
+            t.Errorf("after conversion: found %+v", record)
+        }
+    }
+
+    if countRows(t, "select count(*) from sqlite_master where name = 'persist_Legacy_Code'") != 1 {
+        t.Errorf("index not kept")
+    }
+}
+
+func TestBackup(t *testing.T) {
+    if err := Insert(&Record{ID: "backed-up", Kind: "backup"}); err != nil {
+        t.Fatalf("Insert(backed-up): %v", err)
+    }
+
+    path := filepath.Join(t.TempDir(), "backup.db")
+    if err := Backup(path); err != nil {
+        t.Fatalf("Backup: %v", err)
+    }
+
+    backup, err := NewSQLiteStore(path)
+    if err != nil {
+        t.Fatalf("NewSQLiteStore(backup): %v", err)
+    }
+    defer backup.Close()
+
+    found := Record{ID: "backed-up"}
+    if err = backup.Find(context.Background(), &found); err != nil || found.Kind != "backup" {
+        t.Errorf("Find(backed-up) in backup: found %+v: %v", found, err)
+    }
+
+    if err = Backup(path); err == nil {
+        t.Errorf("Backup over an existing file: expected an error")
+    }
+
+    if err = NewMemoryStore().Backup(context.Background(), path + "2"); !errors.Is(err, ErrUnsupported) {
+        t.Errorf("memory store Backup: expected ErrUnsupported: %v", err)
+    }
+}
@@ -0,0 +1,578 @@
+package persist
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Keeps records in memory, for tests. Rows hold stored values, as the SQL
+// stores would, so that records returned never share memory with those
+// inserted. Primary keys and db-unique columns are enforced; not null
+// columns and defaults are not.
+type memoryStore struct {
+    mu sync.RWMutex
+    tables memoryTables
+}
+
+// Rows of stored values by table name. Rows are replaced rather than
+// modified, so a copy of the tables may share them.
+type memoryTables map[string][][]interface{}
+
+// Runs record operations on a copy of the store's tables, which replaces
+// them when the transaction commits. The store is locked meanwhile.
+type memoryTx struct {
+    tables memoryTables
+}
+
+func NewMemoryStore() Store {
+    return &memoryStore{
+        tables: memoryTables{},
+    }
+}
+
+func (t memoryTables) copy() memoryTables {
+    tables := memoryTables{}
+    for tableName, rows := range t {
+        tables[tableName] = append([][]interface{}{}, rows...)
+    }
+
+    return tables
+}
+
+// Convert a stored value to the type the SQL drivers would return it as.
+func normalize(value interface{}) interface{} {
+    v := reflect.ValueOf(value)
+    switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return v.Int()
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return int64(v.Uint())
+    case reflect.Float32, reflect.Float64:
+        return v.Float()
+    }
+
+    if data, ok := value.([]byte); ok && data != nil {
+        return append([]byte{}, data...)
+    }
+
+    return value
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+    if t, ok := a.(time.Time); ok {
+        u, ok := b.(time.Time)
+        return ok && t.Equal(u)
+    }
+
+    return reflect.DeepEqual(a, b)
+}
+
+func row(r interface{}) ([]interface{}, error) {
+    values, err := getFieldArray(r)
+    if err != nil {
+        return nil, err
+    }
+
+    for i := range values {
+        values[i] = normalize(values[i])
+    }
+
+    return values, nil
+}
+
+// The index of the row in rows with the same primary key as row, or -1.
+func findKey(rows [][]interface{}, pk int, row []interface{}) int {
+    for i, existing := range rows {
+        if equalValues(existing[pk], row[pk]) {
+            return i
+        }
+    }
+
+    return -1
+}
+
+// Check that row, to be stored at index (-1 for a new row), doesn't
+// duplicate the primary key or a unique column of another row.
+func checkUnique(tableName string, columns []column, rows [][]interface{}, row []interface{}, index int) error {
+    for c, col := range columns {
+        if !col.pk && !col.unique {
+            continue
+        }
+
+        for i, existing := range rows {
+            if i != index && equalValues(existing[c], row[c]) {
+                return fmt.Errorf("%w: %s.%s", ErrDuplicate, tableName, col.name)
+            }
+        }
+    }
+
+    return nil
+}
+
+func (t memoryTables) insert(r interface{}) error {
+    row, err := row(r)
+    if err != nil {
+        return err
+    }
+
+    tableName := getTableName(r)
+    if err = checkUnique(tableName, getColumns(r), t[tableName], row, -1); err != nil {
+        return err
+    }
+
+    t[tableName] = append(t[tableName], row)
+
+    return nil
+}
+
+// Call match with the index of each row matching the non-zero fields of r
+// until it returns false.
+func (t memoryTables) match(r interface{}, match func (i int, row []interface{}) bool) error {
+    rValue := reflect.ValueOf(r).Elem()
+    columns := getColumns(r)
+    filter := map[int]interface{}{}
+    for c, col := range columns {
+        field := rValue.Field(col.field)
+        if field.IsZero() {
+            continue
+        }
+
+        value, err := col.encode(field)
+        if err != nil {
+            return err
+        }
+        filter[c] = normalize(value)
+    }
+
+    rows:
+    for i, row := range t[getTableName(r)] {
+        for c, value := range filter {
+            if !equalValues(row[c], value) {
+                continue rows
+            }
+        }
+
+        if !match(i, row) {
+            break
+        }
+    }
+
+    return nil
+}
+
+func scanRow(columns []column, row []interface{}, rValue reflect.Value) error {
+    for c, col := range columns {
+        scanner := fieldScanner{field: rValue.Field(col.field), encoding: col.encoding}
+        if err := scanner.Scan(normalize(row[c])); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (t memoryTables) find(r interface{}) error {
+    var found []interface{}
+    if err := t.match(r, func (i int, row []interface{}) bool {
+        found = row
+        return false
+    }); err != nil {
+        return err
+    }
+
+    if found == nil {
+        return ErrNotFound
+    }
+
+    return scanRow(getColumns(r), found, reflect.ValueOf(r).Elem())
+}
+
+// Compare stored values of the same column, as -1, 0 or 1.
+func compareValues(a interface{}, b interface{}) int {
+    switch v := a.(type) {
+    case int64:
+        w, _ := b.(int64)
+        switch {
+        case v < w:
+            return -1
+        case v > w:
+            return 1
+        }
+    case float64:
+        w, _ := b.(float64)
+        switch {
+        case v < w:
+            return -1
+        case v > w:
+            return 1
+        }
+    case time.Time:
+        w, _ := b.(time.Time)
+        switch {
+        case v.Before(w):
+            return -1
+        case v.After(w):
+            return 1
+        }
+    default:
+        return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+    }
+
+    return 0
+}
+
+// The indexes of the rows matching the non-zero fields of r within rng, in
+// its order.
+func (t memoryTables) matchRange(r interface{}, rng *Range) ([]int, error) {
+    c, from, before, err := rng.bounds(r)
+    if err != nil {
+        return nil, err
+    }
+
+    matched := []int{}
+    err = t.match(r, func (i int, row []interface{}) bool {
+        if (from != nil && compareValues(row[c], normalize(from)) < 0) ||
+                (before != nil && compareValues(row[c], normalize(before)) >= 0) {
+            return true
+        }
+
+        matched = append(matched, i)
+        return true
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if c >= 0 {
+        rows := t[getTableName(r)]
+        pk, pkErr := primaryKeyIndex(r)
+        sort.SliceStable(matched, func (i, j int) bool {
+            order := compareValues(rows[matched[i]][c], rows[matched[j]][c])
+            if order == 0 && pkErr == nil {
+                order = compareValues(rows[matched[i]][pk], rows[matched[j]][pk])
+            }
+
+            if rng.Descending {
+                return order > 0
+            }
+
+            return order < 0
+        })
+    }
+
+    if rng.Limit > 0 && len(matched) > rng.Limit {
+        matched = matched[:rng.Limit]
+    }
+
+    return matched, nil
+}
+
+func (t memoryTables) findRange(r interface{}, rng Range, records interface{}) error {
+    recordsValue, err := checkRecords(r, records)
+    if err != nil {
+        return err
+    }
+
+    matched, err := t.matchRange(r, &rng)
+    if err != nil {
+        return err
+    }
+
+    rows := t[getTableName(r)]
+    slice := recordsValue.Elem()
+    for _, i := range matched {
+        record := reflect.New(slice.Type().Elem()).Elem()
+        if err = scanRow(getColumns(r), rows[i], record); err != nil {
+            return err
+        }
+
+        slice = reflect.Append(slice, record)
+    }
+    recordsValue.Elem().Set(slice)
+
+    return nil
+}
+
+// Store row in place of the row with its primary key, returning whether
+// there was one.
+func (t memoryTables) replace(r interface{}, row []interface{}) (bool, error) {
+    pk, err := primaryKeyIndex(r)
+    if err != nil {
+        return false, err
+    }
+
+    tableName := getTableName(r)
+    rows := t[tableName]
+    i := findKey(rows, pk, row)
+    if i < 0 {
+        return false, nil
+    }
+
+    if err = checkUnique(tableName, getColumns(r), rows, row, i); err != nil {
+        return false, err
+    }
+    rows[i] = row
+
+    return true, nil
+}
+
+func (t memoryTables) update(r interface{}) error {
+    row, err := row(r)
+    if err != nil {
+        return err
+    }
+
+    updated, err := t.replace(r, row)
+    if err == nil && !updated {
+        return ErrNotFound
+    }
+
+    return err
+}
+
+func (t memoryTables) upsert(r interface{}) error {
+    row, err := row(r)
+    if err != nil {
+        return err
+    }
+
+    updated, err := t.replace(r, row)
+    if err != nil || updated {
+        return err
+    }
+
+    tableName := getTableName(r)
+    if err = checkUnique(tableName, getColumns(r), t[tableName], row, -1); err != nil {
+        return err
+    }
+    t[tableName] = append(t[tableName], row)
+
+    return nil
+}
+
+func (t memoryTables) delete(r interface{}) error {
+    pk, err := primaryKeyIndex(r)
+    if err != nil {
+        return err
+    }
+
+    row, err := row(r)
+    if err != nil {
+        return err
+    }
+
+    tableName := getTableName(r)
+    rows := t[tableName]
+    if i := findKey(rows, pk, row); i >= 0 {
+        t[tableName] = append(rows[:i:i], rows[i+1:]...)
+    }
+
+    return nil
+}
+
+func (t memoryTables) deleteRange(r interface{}, rng Range) (int64, error) {
+    matched, err := t.matchRange(r, &Range{Field: rng.Field, From: rng.From, Before: rng.Before})
+    if err != nil {
+        return 0, err
+    }
+
+    deleted := map[int]bool{}
+    for _, i := range matched {
+        deleted[i] = true
+    }
+
+    tableName := getTableName(r)
+    kept := [][]interface{}{}
+    for i, row := range t[tableName] {
+        if !deleted[i] {
+            kept = append(kept, row)
+        }
+    }
+    t[tableName] = kept
+
+    return int64(len(matched)), nil
+}
+
+// Call fn with the tables, locked for reading, unless ctx is done.
+func (s *memoryStore) read(ctx context.Context, fn func (t memoryTables) error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return fn(s.tables)
+}
+
+// Call fn with the tables, locked for writing, unless ctx is done.
+func (s *memoryStore) write(ctx context.Context, fn func (t memoryTables) error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return fn(s.tables)
+}
+
+func (s *memoryStore) Insert(ctx context.Context, r interface{}) error {
+    return s.write(ctx, func (t memoryTables) error {
+        return t.insert(r)
+    })
+}
+
+func (s *memoryStore) Find(ctx context.Context, r interface{}) error {
+    return s.read(ctx, func (t memoryTables) error {
+        return t.find(r)
+    })
+}
+
+func (s *memoryStore) FindAll(ctx context.Context, r interface{}, records interface{}) error {
+    return s.FindRange(ctx, r, Range{}, records)
+}
+
+func (s *memoryStore) FindRange(ctx context.Context, r interface{}, rng Range, records interface{}) error {
+    return s.read(ctx, func (t memoryTables) error {
+        return t.findRange(r, rng, records)
+    })
+}
+
+func (s *memoryStore) Update(ctx context.Context, r interface{}) error {
+    return s.write(ctx, func (t memoryTables) error {
+        return t.update(r)
+    })
+}
+
+func (s *memoryStore) Upsert(ctx context.Context, r interface{}) error {
+    return s.write(ctx, func (t memoryTables) error {
+        return t.upsert(r)
+    })
+}
+
+func (s *memoryStore) Delete(ctx context.Context, r interface{}) error {
+    return s.write(ctx, func (t memoryTables) error {
+        return t.delete(r)
+    })
+}
+
+func (s *memoryStore) DeleteRange(ctx context.Context, r interface{}, rng Range) (int64, error) {
+    var deleted int64
+    err := s.write(ctx, func (t memoryTables) error {
+        var err error
+        deleted, err = t.deleteRange(r, rng)
+        return err
+    })
+
+    return deleted, err
+}
+
+func (s *memoryStore) WithTx(ctx context.Context, fn func (tx Records) error) error {
+    return s.write(ctx, func (t memoryTables) error {
+        tx := &memoryTx{tables: t.copy()}
+        if err := fn(tx); err != nil {
+            return err
+        }
+
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        s.tables = tx.tables
+
+        return nil
+    })
+}
+
+func (s *memoryStore) DropTable(ctx context.Context, r interface{}) error {
+    return s.write(ctx, func (t memoryTables) error {
+        delete(t, getTableName(r))
+        return nil
+    })
+}
+
+func (s *memoryStore) Exec(ctx context.Context, query string, args ...interface{}) error {
+    return fmt.Errorf("%w: %s", ErrUnsupported, query)
+}
+
+// Records in memory need no migration.
+func (s *memoryStore) Migrate(ctx context.Context, dryRun bool) ([]Migration, error) {
+    return nil, nil
+}
+
+func (s *memoryStore) Backup(ctx context.Context, path string) error {
+    return fmt.Errorf("%w: backup of records in memory", ErrUnsupported)
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+    return nil
+}
+
+func (s *memoryStore) Close() error {
+    return nil
+}
+
+func (tx *memoryTx) Insert(ctx context.Context, r interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.insert(r)
+}
+
+func (tx *memoryTx) Find(ctx context.Context, r interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.find(r)
+}
+
+func (tx *memoryTx) FindAll(ctx context.Context, r interface{}, records interface{}) error {
+    return tx.FindRange(ctx, r, Range{}, records)
+}
+
+func (tx *memoryTx) FindRange(ctx context.Context, r interface{}, rng Range, records interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.findRange(r, rng, records)
+}
+
+func (tx *memoryTx) Update(ctx context.Context, r interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.update(r)
+}
+
+func (tx *memoryTx) Upsert(ctx context.Context, r interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.upsert(r)
+}
+
+func (tx *memoryTx) Delete(ctx context.Context, r interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    return tx.tables.delete(r)
+}
+
+func (tx *memoryTx) DeleteRange(ctx context.Context, r interface{}, rng Range) (int64, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+
+    return tx.tables.deleteRange(r, rng)
+}
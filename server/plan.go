@@ -0,0 +1,197 @@
+// Client plans (service tiers) and quota enforcement.
+package main
+
+import (
+    "fmt"
+    "errors"
+    "sort"
+    "time"
+
+    "mutex/server/persist"
+    "mutex/server/ratelimit"
+)
+
+// A Plan governs the limits applied to every client assigned to it. Plans
+// are stored in the database and assigned by name through
+// ClientInfo.Plan; a client without a (valid) plan gets DefaultPlan. A
+// zero limit means "no limit", except for MaxWaitMs where it means the
+// client may not wait at all.
+type Plan struct {
+    Name string `json:"name" db-pk:"true"`
+    MaxWaitMs int64 `json:"maxWaitMs"`
+    MaxLeaseMs int64 `json:"maxLeaseMs"`
+    MaxMutexes int `json:"maxMutexes"`
+    MaxWaiters int `json:"maxWaiters"`
+    MaxRequestsPerMinute int `json:"maxRequestsPerMinute"`
+}
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrInvalidPlan = errors.New("invalid plan")
+var ErrPlanNotFound = errors.New("plan not found")
+
+// The plan used for clients that haven't been assigned one, configured
+// from the command line.
+func DefaultPlan() *Plan {
+    return &Plan{
+        Name: "default",
+        MaxWaitMs: MaxWaitDuration.Milliseconds(),
+        MaxLeaseMs: MaxLeaseDuration.Milliseconds(),
+        MaxMutexes: *MaxMutexes,
+        MaxWaiters: *MaxWaiters,
+        MaxRequestsPerMinute: *MaxRequestsPerMinute,
+    }
+}
+
+func (p *Plan) MaxWait() time.Duration {
+    return time.Duration(p.MaxWaitMs) * time.Millisecond
+}
+
+func (p *Plan) MaxLease() time.Duration {
+    return time.Duration(p.MaxLeaseMs) * time.Millisecond
+}
+
+func (p *Plan) newRequestLimiter() *ratelimit.TokenBucket {
+    if p.MaxRequestsPerMinute <= 0 {
+        return nil
+    }
+
+    return ratelimit.NewTokenBucket(float64(p.MaxRequestsPerMinute) / 60.0, p.MaxRequestsPerMinute)
+}
+
+// Look up a plan by name, falling back to the default plan if it isn't
+// found.
+func LoadPlan(name string) *Plan {
+    if name == "" {
+        return DefaultPlan()
+    }
+
+    plan := Plan{
+        Name: name,
+    }
+
+    if persist.Find(&plan) != nil {
+        return DefaultPlan()
+    }
+
+    return &plan
+}
+
+// The stored plans, by name.
+func ListPlans() ([]Plan, error) {
+    plans := []Plan{}
+    if err := persist.FindAll(&Plan{}, &plans); err != nil {
+        return nil, err
+    }
+
+    sort.Slice(plans, func (i, j int) bool {
+        return plans[i].Name < plans[j].Name
+    })
+
+    return plans, nil
+}
+
+// Store a plan, replacing any of the same name, and apply it to the loaded
+// resources of the clients assigned to it.
+func SavePlan(plan *Plan) error {
+    if plan.Name == "" || plan.MaxWaitMs < 0 || plan.MaxLeaseMs < 0 || plan.MaxMutexes < 0 ||
+            plan.MaxWaiters < 0 || plan.MaxRequestsPerMinute < 0 {
+        return fmt.Errorf("%w: a plan needs a name and its limits can't be negative", ErrInvalidPlan)
+    }
+
+    if err := persist.Upsert(plan); err != nil {
+        return err
+    }
+
+    clients := []ClientInfo{}
+    if err := persist.FindAll(&ClientInfo{Plan: plan.Name}, &clients); err != nil {
+        return err
+    }
+
+    accounts := map[string]bool{}
+    for _, client := range clients {
+        accounts[client.Email] = true
+    }
+    applyPlan(accounts, plan)
+
+    return nil
+}
+
+// Assign a client the named plan, or the default plan if name is empty,
+// taking effect immediately.
+func AssignPlan(email string, name string) error {
+    clientInfo, err := FindClient(email)
+    if err != nil {
+        return fmt.Errorf("%w: '%s'", ErrClientNotFound, email)
+    }
+
+    if name != "" && persist.Find(&Plan{Name: name}) != nil {
+        return fmt.Errorf("%w: '%s'", ErrPlanNotFound, name)
+    }
+
+    clientInfo.Plan = name
+    if err = persist.Update(clientInfo); err != nil {
+        return err
+    }
+
+    applyPlan(map[string]bool{email: true}, LoadPlan(name))
+
+    return nil
+}
+
+// Replace the plan of the loaded resources (accounts and the namespaces
+// they own) of accounts.
+func applyPlan(accounts map[string]bool, plan *Plan) {
+    if len(accounts) == 0 {
+        return
+    }
+
+    loaded := map[string]*ClientResources{}
+    crmMutex.RLock()
+    for key, cr := range clientResourceMap {
+        loaded[key] = cr
+    }
+    crmMutex.RUnlock()
+
+    for key, cr := range loaded {
+        if account, err := resourcesAccount(key); err != nil || !accounts[account] {
+            continue
+        }
+
+        cr.mu.Lock()
+        cr.plan = plan
+        cr.requestLimiter = plan.newRequestLimiter()
+        cr.mu.Unlock()
+    }
+}
+
+func GetClientPlan(account string) *Plan {
+    cr := getClientResources(account)
+
+    cr.mu.RLock()
+    defer cr.mu.RUnlock()
+
+    if cr.plan == nil {
+        return DefaultPlan()
+    }
+
+    return cr.plan
+}
+
+// Count an API request against the client's request rate quota. Returns
+// how long the client should wait before retrying if the quota has been
+// exceeded.
+func CheckRequestRate(account string) (time.Duration, error) {
+    cr := lockClientResources(account)
+    limiter := cr.requestLimiter
+    cr.mu.Unlock()
+
+    if limiter == nil {
+        return 0, nil
+    }
+
+    if err := limiter.Take(1, 0, nil); err != nil {
+        return limiter.RetryAfter(1), fmt.Errorf("%w: request rate limit exceeded", ErrQuotaExceeded)
+    }
+
+    return 0, nil
+}
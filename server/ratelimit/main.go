@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrBurstExceeded = errors.New("take failed: token count exceeds bucket burst size")
+
+// TokenBucket limits throughput: tokens are replenished continuously at
+// rate tokens per second up to burst, and each Take consumes n of them.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 || burst < 1 {
+		return nil
+	}
+
+	b := new(TokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = b.burst
+	b.last = time.Now()
+
+	return b
+}
+
+// Change the replenish rate and burst size of an existing bucket. Tokens
+// already accumulated are kept, capped at the new burst size.
+func (b *TokenBucket) SetLimits(rate float64, burst int) bool {
+	if rate <= 0 || burst < 1 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = math.Min(b.tokens, b.burst)
+
+	return true
+}
+
+// Report whether the bucket has refilled to its burst size.
+func (b *TokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+
+	return b.tokens >= b.burst
+}
+
+// Return the number of whole tokens currently available.
+func (b *TokenBucket) Available() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+
+	return int(b.tokens)
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// Take n tokens from the bucket, waiting up to timeout for them to become
+// available. A negative timeout waits indefinitely. If the tokens cannot
+// possibly be replenished before the timeout expires Take fails
+// immediately rather than sleeping for nothing.
+func (b *TokenBucket) Take(n int, timeout time.Duration, done <-chan struct{}) error {
+	if n < 1 {
+		return errors.New("take failed: token count must be positive")
+	}
+
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.refill(now)
+
+		if float64(n) > b.burst {
+			b.mu.Unlock()
+			return ErrBurstExceeded
+		}
+
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return nil
+		}
+
+		wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if !deadline.IsZero() && now.Add(wait).After(deadline) {
+			return errors.New("take failed: wait timeout expired")
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return errors.New("take failed: client disconnected")
+		case <-timer.C:
+		}
+	}
+}
+
+// Estimate how long a caller would need to wait for n tokens.
+func (b *TokenBucket) RetryAfter(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= float64(n) {
+		return 0
+	}
+
+	return time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+}
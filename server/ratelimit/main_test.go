@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	bucket := NewTokenBucket(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if err := bucket.Take(1, 0, nil); err != nil {
+			t.Fatalf("take %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if err := bucket.Take(1, 0, nil); err == nil {
+		t.Errorf("take from empty bucket: expected error")
+	}
+
+	if err := bucket.Take(4, -1, nil); err == nil {
+		t.Errorf("take more than burst: expected error")
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := NewTokenBucket(20, 1)
+
+	if err := bucket.Take(1, 0, nil); err != nil {
+		t.Fatalf("first take: unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if err := bucket.Take(1, 500*time.Millisecond, nil); err != nil {
+		t.Fatalf("waiting take: unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("waiting take returned after %v, expected ~50ms", elapsed)
+	}
+}
+
+func TestTokenBucketDone(t *testing.T) {
+	bucket := NewTokenBucket(0.1, 1)
+	_ = bucket.Take(1, 0, nil)
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(done)
+	}()
+
+	if err := bucket.Take(1, -1, done); err == nil {
+		t.Errorf("take after disconnect: expected error")
+	}
+}
+
+func TestNewTokenBucketInvalid(t *testing.T) {
+	if NewTokenBucket(0, 1) != nil || NewTokenBucket(1, 0) != nil {
+		t.Errorf("invalid limits: expected nil bucket")
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	bucket := NewTokenBucket(50, 1)
+
+	if !bucket.Full() {
+		t.Errorf("new bucket: expected full")
+	}
+
+	bucket.Take(1, 0, nil)
+	if bucket.Full() {
+		t.Errorf("after take: expected not full")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if !bucket.Full() {
+		t.Errorf("after refill: expected full")
+	}
+}
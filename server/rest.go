@@ -2,15 +2,19 @@
 package main
 
 import (
-    "log"
     "fmt"
     "bytes"
+    "errors"
+    "crypto/subtle"
+    "sync/atomic"
     "strings"
 	"encoding/json"
     "math"
     "strconv"
     "time"
     "net/http"
+
+    "mutex/server/tracing"
 )
 
 type HttpError struct {
@@ -22,6 +26,30 @@ type HttpSuccess struct {
     StatusCode int `json:"statusCode"`
 }
 
+type HttpMutexStatus struct {
+    StatusCode int `json:"statusCode"`
+    Locked bool `json:"locked"`
+    Waiters int `json:"waiters"`
+}
+
+type HttpLockSuccess struct {
+    StatusCode int `json:"statusCode"`
+    // identifies this lock; pass it to unlock to be sure of releasing it
+    // and not a later lock
+    Token uint64 `json:"token"`
+}
+
+type HttpRenewSuccess struct {
+    StatusCode int `json:"statusCode"`
+    // the lease granted, zero if the mutex is held until it is unlocked
+    LeaseMs int64 `json:"leaseMs"`
+}
+
+type HttpTakeSuccess struct {
+    StatusCode int `json:"statusCode"`
+    Remaining int `json:"remaining"`
+}
+
 // Marshal JSON without escaping <, >, and & characters.
 func JSONMarshal(t interface{}) ([]byte, error) {
     buffer := &bytes.Buffer{}
@@ -39,15 +67,139 @@ func WriteJSON(w http.ResponseWriter, req *http.Request, o interface{}) bool {
 	_, err := w.Write(data)
 
     if err != nil {
-        log.Printf("WriteJSON error %v", err)
+        requestLogger(req.Context()).Warn("response write failed", "error", err)
     }
     return err == nil
 }
 
+// Report a quota error as 429 Too Many Requests, anything else with the
+// given status code.
+func reportQuotaError(w http.ResponseWriter, req *http.Request, statusCode int, err error) {
+    if errors.Is(err, ErrQuotaExceeded) {
+        statusCode = 429
+    }
+
+    reportError(w, req, statusCode, err.Error())
+}
+
+// Charge a request against the client's request rate quota, reporting an
+// error to the client if it has been exceeded.
+func checkRequestRate(w http.ResponseWriter, req *http.Request, account string) bool {
+    retryAfter, err := CheckRequestRate(account)
+    if err != nil {
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+        reportQuotaError(w, req, 429, err)
+
+        return false
+    }
+
+    return true
+}
+
+// Extract the API key from an "Authorization: Bearer" request header.
+func bearerToken(req *http.Request) string {
+    authorization := req.Header.Get("Authorization")
+    if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+        return strings.TrimSpace(authorization[7:])
+    }
+
+    return ""
+}
+
+// Obscure a key so it can be logged or echoed back in an error message.
+func redactKey(key string) string {
+    if len(key) <= 8 {
+        return strings.Repeat("*", len(key))
+    }
+
+    return keyPrefix(key) + "..."
+}
+
+// Verify the API key, reporting an error to the client if it is invalid.
+func verifyClient(w http.ResponseWriter, req *http.Request, apiKey string) (*Credential, bool) {
+    _, span := tracer.Start(req.Context(), "verify client", tracing.KindInternal)
+    defer span.End()
+
+    if apiKey == "" {
+        span.SetError(errors.New("missing API key"))
+        w.Header().Set("WWW-Authenticate", `Bearer realm="mutex.us"`)
+        reportError(w, req, 401, "missing API key (use an 'Authorization: Bearer {apiKey}' header)")
+
+        return nil, false
+    }
+
+    credential, ok := VerifyClient(apiKey)
+    if !ok {
+        span.SetError(errors.New("invalid API key"))
+        w.Header().Set("WWW-Authenticate", `Bearer realm="mutex.us", error="invalid_token"`)
+        reportError(w, req, 401, fmt.Sprintf("client id '%s' is invalid", redactKey(apiKey)))
+
+        return nil, false
+    }
+
+    if ClientSuspended(credential.Account) {
+        span.SetError(errors.New("client suspended"))
+        reportError(w, req, 403, "client is suspended")
+
+        return nil, false
+    }
+
+    return credential, true
+}
+
+// Resolve the namespace named by the request's namespace parameter (the
+// account's private namespace if there isn't one) to the key of its
+// resources, reporting an error to the client if it can't be used.
+func resolveNamespace(w http.ResponseWriter, req *http.Request, credential *Credential) (string, bool) {
+    namespace := req.URL.Query().Get("namespace")
+
+    if namespace != "" && credential.Scope != nil {
+        reportError(w, req, 403, "restricted api keys may not use shared namespaces")
+
+        return "", false
+    }
+
+    resources, err := ResolveNamespace(credential.Account, namespace)
+    if err != nil {
+        reportNamespaceError(w, req, err)
+
+        return "", false
+    }
+
+    return resources, true
+}
+
+func reportNamespaceError(w http.ResponseWriter, req *http.Request, err error) {
+    if errors.Is(err, ErrNamespaceNotFound) {
+        reportError(w, req, 404, err.Error())
+    } else if errors.Is(err, ErrNamespaceAccess) {
+        reportError(w, req, 403, err.Error())
+    } else {
+        reportError(w, req, 400, err.Error())
+    }
+}
+
+// Check that the credential allows op on the identified resource,
+// reporting an error to the client if it doesn't.
+func authorize(w http.ResponseWriter, req *http.Request, credential *Credential, op string,
+            identifier string) bool {
+    if !credential.Allows(op, identifier) {
+        reportError(w, req, 403, fmt.Sprintf("api key is not permitted to %s '%s'", op, identifier))
+
+        return false
+    }
+
+    return true
+}
+
 // Set the HTTP status code and return an error JSON payload to the client.
 func reportError(w http.ResponseWriter, req *http.Request, statusCode int, errorMessage string) {
-    // !!!TBD!!! wsm - consider logging errors here
-    log.Printf("reportError: %s: %s", req.RemoteAddr, errorMessage)
+    reqLogger := requestLogger(req.Context())
+    if statusCode >= 500 {
+        reqLogger.Error("request failed", "status", statusCode, "error", errorMessage)
+    } else {
+        reqLogger.Info("request failed", "status", statusCode, "error", errorMessage)
+    }
 	w.WriteHeader(statusCode)
 
 	errorBody := &HttpError{
@@ -58,39 +210,74 @@ func reportError(w http.ResponseWriter, req *http.Request, statusCode int, error
     WriteJSON(w, req, errorBody)
 }
 
-func statsHandler(w http.ResponseWriter, req *http.Request) {
-    args := req.URL.Query()
+// Report whether the request carries the admin credential in an
+// "Authorization: Bearer" header.
+func isAdmin(req *http.Request) bool {
+    adminID := bearerToken(req)
+
+    return adminID != "" && subtle.ConstantTimeCompare([]byte(adminID), []byte(*AdminID)) == 1
+}
 
-    if adminID := string(args.Get("adminID")); adminID != *AdminID {
-        reportError(w, req, 401, fmt.Sprintf("adminID '%s' is invalid", adminID))
+type HttpStats struct {
+    TotalClients int `json:"totalClients"`
+    TotalLocks int64 `json:"totalLocks"`
+    TotalUnlocks int64 `json:"totalUnlocks"`
+    TotalTakes int64 `json:"totalTakes"`
+    TotalIdleClients int64 `json:"totalIdleClients"`
+}
+
+func statsHandler(w http.ResponseWriter, req *http.Request) {
+    if !isAdmin(req) {
+        reportError(w, req, 401, "admin credential required")
 
         return
     }
 
-    w.Header().Set("Content-Type", "application/json; charset=utf8")
-    w.Write([]byte(fmt.Sprintf(`"{totalClients": %d`, len(clientResourceMap))))
-    var totalLocks int64
-    var totalUnlocks int64
-    var totalIdleClients int64
+    crmMutex.RLock()
+    stats := &HttpStats{
+        TotalClients: len(clientResourceMap),
+    }
 
+    stats.TotalLocks = atomic.LoadInt64(&totalLocks)
+    stats.TotalUnlocks = atomic.LoadInt64(&totalUnlocks)
+    stats.TotalTakes = atomic.LoadInt64(&totalTakes)
+
+    // idle clients hold no mutexes and have no requests waiting
     for _, cr := range clientResourceMap {
-        totalLocks += int64(*cr.totalLocks)
-        totalUnlocks += int64(*cr.totalUnlocks)
-        if *cr.totalLocks == cr.previousTotalLocks && *cr.totalUnlocks == cr.previousTotalUnlocks {
-            totalIdleClients += 1
+        cr.mu.RLock()
+        if cr.heldMutexes == 0 && !cr.hasWaiters() {
+            stats.TotalIdleClients += 1
         }
+        cr.mu.RUnlock()
     }
-    w.Write([]byte(fmt.Sprintf(`, "totalLocks": %d, "totalUnlocks": %d, "totalIdleClients": %d`,
-            totalLocks, totalUnlocks, totalIdleClients)))
-    w.Write([]byte("}"))
+    crmMutex.RUnlock()
+
+    WriteJSON(w, req, stats)
+}
+
+// The response to a registration request. Status is "pending" until the
+// client's email address has been verified.
+type RegistrationInfo struct {
+    Email string `json:"email"`
+    ClientID string `json:"clientID,omitempty"`
+    Status string `json:"status"`
 }
 
 func apiClientHandler(w http.ResponseWriter, req *http.Request) {
+    args := req.URL.Query()
+
+    if args.Has("verify") {
+        apiVerifyHandler(w, req)
+
+        return
+    }
+
 	if req.Method != "POST" {
 		reportError(w, req, 400, "use POST to register a new client")
+
+        return
 	}
 
-    args := req.URL.Query()
     if !args.Has("register") || !args.Has("email") {
         reportError(w, req, 400, "usage: /api/client?register&email=[ValidEmailAddress]")
 
@@ -99,10 +286,50 @@ func apiClientHandler(w http.ResponseWriter, req *http.Request) {
 
     email := string(args.Get("email"))
 
-    clientInfo, err := RegisterClient(email)
+    retryAfter, err := CheckRegistrationRate(req.RemoteAddr, email)
+    if err != nil {
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+        reportQuotaError(w, req, 429, err)
+
+        return
+    }
+
+    // links are only ever built from the configured URL: the Host header is
+    // chosen by the client, who could have the token sent to their own host
+    verifyURL := strings.TrimSuffix(*BaseURL, "/") + "/api/client"
+
+    clientInfo, pending, err := RegisterClient(email, verifyURL)
     if err != nil {
-        if (strings.HasPrefix(err.Error(), "UNIQUE constraint failed")) {
+        if errors.Is(err, ErrDuplicateClient) {
             reportError(w, req, 400, fmt.Sprintf("email '%s' is already in use", email))
+        } else if errors.Is(err, ErrInvalidEmail) {
+            reportError(w, req, 400, err.Error())
+        } else {
+            reportError(w, req, 500, err.Error())
+        }
+
+        return
+    }
+
+    registrationInfo := &RegistrationInfo{
+        Email: clientInfo.Email,
+        ClientID: clientInfo.ClientID,
+        Status: "active",
+    }
+
+    if pending {
+        registrationInfo.Status = "pending"
+        w.WriteHeader(202)
+    }
+
+    WriteJSON(w, req, registrationInfo)
+}
+
+func apiVerifyHandler(w http.ResponseWriter, req *http.Request) {
+    email, err := ConfirmRegistration(req.URL.Query().Get("token"))
+    if err != nil {
+        if errors.Is(err, ErrDuplicateClient) || errors.Is(err, ErrInvalidToken) {
+            reportError(w, req, 400, err.Error())
         } else {
             reportError(w, req, 500, err.Error())
         }
@@ -110,20 +337,43 @@ func apiClientHandler(w http.ResponseWriter, req *http.Request) {
         return
     }
 
-    WriteJSON(w, req, clientInfo)
+    WriteJSON(w, req, &RegistrationInfo{
+        Email: email,
+        Status: "active",
+    })
 }
 
-func apiMutexHandler(w http.ResponseWriter, req *http.Request, clientID string, mutexIdentifier string) {
-    if !VerifyClient(clientID) {
-        reportError(w, req, 401, fmt.Sprintf("client id '%s' is invalid", clientID))
+func apiMutexHandler(w http.ResponseWriter, req *http.Request, apiKey string, mutexIdentifier string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+    account := credential.Account
 
+    if !checkRequestRate(w, req, account) {
         return
     }
 
+    resources, ok := resolveNamespace(w, req, credential)
+    if !ok {
+        return
+    }
 
     args := req.URL.Query()
 
     switch {
+        case args.Has("status"):
+            if !authorize(w, req, credential, OpStatus, mutexIdentifier) {
+                return
+            }
+
+            locked, waiters := GetMutexStatus(resources, mutexIdentifier)
+
+            WriteJSON(w, req, &HttpMutexStatus{
+                StatusCode: 200,
+                Locked: locked,
+                Waiters: waiters,
+            })
         case args.Has("lock"):
             if req.Method != "POST" {
                 reportError(w, req, 400, "use POST for lock operation")
@@ -131,24 +381,51 @@ func apiMutexHandler(w http.ResponseWriter, req *http.Request, clientID string,
                 return
             }
 
-            waitTimeoutMs := GetMaxWaitTimeout(clientID)
+            if !authorize(w, req, credential, OpLock, mutexIdentifier) {
+                return
+            }
+
+            waitTimeoutMs := GetMaxWaitTimeout(resources)
             if args.Has("waitTimeoutMs") {
                 waitArgString := string(args.Get("waitTimeoutMs"))
                 if waitArg, err := strconv.Atoi(waitArgString); err == nil {
+                    // a negative timeout would wait indefinitely, past the plan's limit
+                    if waitArg < 0 {
+                        reportError(w, req, 400, fmt.Sprintf("invalid waitTimeoutMs '%s'", waitArgString))
+
+                        return
+                    }
+
                     waitTimeoutMs = time.Duration(math.Min(float64(waitTimeoutMs),
                             float64(time.Duration(waitArg) * time.Millisecond)))
                 }
             }
 
-            if err := LockSemaphore(clientID, mutexIdentifier, waitTimeoutMs,
-                        req.Context().Done()); err != nil {
-                reportError(w, req, 409, err.Error())
+            var lease time.Duration
+            if args.Has("leaseMs") {
+                leaseArgString := string(args.Get("leaseMs"))
+                if leaseArg, err := strconv.Atoi(leaseArgString); err == nil {
+                    lease = time.Duration(leaseArg) * time.Millisecond
+                }
+            }
+            lease = GetLeaseDuration(resources, lease)
+
+            holder, err := LockSemaphore(req.Context(), resources, mutexIdentifier, waitTimeoutMs, lease)
+            recordRequestAudit(req, account, resources, AuditLock, mutexIdentifier, holder, err)
+            if errors.Is(err, ErrDraining) {
+                w.Header().Set("Retry-After", drainRetryAfter)
+                reportError(w, req, 503, err.Error())
+
+                return
+            } else if err != nil {
+                reportQuotaError(w, req, 409, err)
 
                 return
             }
 
-            success := &HttpSuccess{
+            success := &HttpLockSuccess{
                 StatusCode: 200,
+                Token: holder,
             }
 
             w.WriteHeader(200)
@@ -160,7 +437,31 @@ func apiMutexHandler(w http.ResponseWriter, req *http.Request, clientID string,
                 return
             }
 
-            if err := UnlockSemaphore(clientID, mutexIdentifier); err != nil {
+            if !authorize(w, req, credential, OpLock, mutexIdentifier) {
+                return
+            }
+
+            var token uint64
+            if args.Has("token") {
+                var err error
+                if token, err = strconv.ParseUint(args.Get("token"), 10, 64); err != nil {
+                    reportError(w, req, 400, fmt.Sprintf("invalid token '%s'", args.Get("token")))
+
+                    return
+                }
+            }
+
+            holder, err := UnlockSemaphore(resources, mutexIdentifier, token)
+            if err != nil {
+                // record the token the client tried to unlock with
+                holder = token
+            }
+            recordRequestAudit(req, account, resources, AuditUnlock, mutexIdentifier, holder, err)
+            if errors.Is(err, ErrTokenRequired) {
+                reportError(w, req, 400, err.Error())
+
+                return
+            } else if err != nil {
                 reportError(w, req, 409, err.Error())
 
                 return
@@ -172,8 +473,344 @@ func apiMutexHandler(w http.ResponseWriter, req *http.Request, clientID string,
 
             w.WriteHeader(200)
             WriteJSON(w, req, success)
+        case args.Has("renew"):
+            if req.Method != "POST" {
+                reportError(w, req, 400, "use POST for renew operation")
+
+                return
+            }
+
+            if !authorize(w, req, credential, OpLock, mutexIdentifier) {
+                return
+            }
+
+            token, err := strconv.ParseUint(args.Get("token"), 10, 64)
+            if err != nil && args.Has("token") {
+                reportError(w, req, 400, fmt.Sprintf("invalid token '%s'", args.Get("token")))
+
+                return
+            }
+
+            var lease time.Duration
+            if leaseArg, err := strconv.Atoi(args.Get("leaseMs")); err == nil {
+                lease = time.Duration(leaseArg) * time.Millisecond
+            }
+
+            lease, err = RenewLease(req.Context(), resources, mutexIdentifier, token, lease)
+            recordRequestAudit(req, account, resources, AuditRenew, mutexIdentifier, token, err)
+            if errors.Is(err, ErrTokenRequired) {
+                reportError(w, req, 400, err.Error())
+
+                return
+            } else if err != nil {
+                reportError(w, req, 409, err.Error())
+
+                return
+            }
+
+            WriteJSON(w, req, &HttpRenewSuccess{
+                StatusCode: 200,
+                LeaseMs: lease.Milliseconds(),
+            })
 
         default:
             reportError(w, req, 400, "bad request")
     }
 }
+
+func apiRateLimitHandler(w http.ResponseWriter, req *http.Request, apiKey string, limiterIdentifier string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+    account := credential.Account
+
+    if !checkRequestRate(w, req, account) {
+        return
+    }
+
+    resources, ok := resolveNamespace(w, req, credential)
+    if !ok {
+        return
+    }
+
+    args := req.URL.Query()
+
+    if !args.Has("take") {
+        reportError(w, req, 400, "bad request")
+
+        return
+    }
+
+    if req.Method != "POST" {
+        reportError(w, req, 400, "use POST for take operation")
+
+        return
+    }
+
+    if !authorize(w, req, credential, OpTake, limiterIdentifier) {
+        return
+    }
+
+    n := 1
+    if args.Has("n") {
+        var err error
+        if n, err = strconv.Atoi(args.Get("n")); err != nil || n < 1 {
+            reportError(w, req, 400, fmt.Sprintf("invalid token count '%s'", args.Get("n")))
+
+            return
+        }
+    }
+
+    // rate is expressed in tokens per interval (default one second) and
+    // only needs to be supplied when creating or reconfiguring a limiter
+    var rate float64
+    // burst defaults to the rate per interval
+    burst := 1
+    if args.Has("rate") {
+        var err error
+        if rate, err = strconv.ParseFloat(args.Get("rate"), 64); err != nil || rate <= 0 {
+            reportError(w, req, 400, fmt.Sprintf("invalid rate '%s'", args.Get("rate")))
+
+            return
+        }
+        burst = int(math.Max(1, math.Ceil(rate)))
+
+        interval := time.Second
+        if args.Has("interval") {
+            if interval, err = time.ParseDuration(args.Get("interval")); err != nil || interval <= 0 {
+                reportError(w, req, 400, fmt.Sprintf("invalid interval '%s'", args.Get("interval")))
+
+                return
+            }
+        }
+
+        rate = rate / interval.Seconds()
+    }
+
+    if args.Has("burst") {
+        var err error
+        if burst, err = strconv.Atoi(args.Get("burst")); err != nil || burst < 1 {
+            reportError(w, req, 400, fmt.Sprintf("invalid burst '%s'", args.Get("burst")))
+
+            return
+        }
+    }
+
+    waitTimeoutMs := time.Duration(0)
+    if args.Has("waitTimeoutMs") {
+        waitArgString := string(args.Get("waitTimeoutMs"))
+        if waitArg, err := strconv.Atoi(waitArgString); err == nil {
+            // a negative timeout would wait indefinitely, past the plan's limit
+            if waitArg < 0 {
+                reportError(w, req, 400, fmt.Sprintf("invalid waitTimeoutMs '%s'", waitArgString))
+
+                return
+            }
+
+            waitTimeoutMs = time.Duration(math.Min(float64(GetMaxWaitTimeout(resources)),
+                    float64(time.Duration(waitArg) * time.Millisecond)))
+        }
+    }
+
+    remaining, retryAfter, err := TakeTokens(req.Context(), resources, limiterIdentifier, n, rate, burst,
+            waitTimeoutMs)
+    if err != nil {
+        if retryAfter > 0 {
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+            reportError(w, req, 429, err.Error())
+        } else {
+            reportError(w, req, 400, err.Error())
+        }
+
+        return
+    }
+
+    success := &HttpTakeSuccess{
+        StatusCode: 200,
+        Remaining: remaining,
+    }
+
+    w.WriteHeader(200)
+    WriteJSON(w, req, success)
+}
+
+func apiKeysHandler(w http.ResponseWriter, req *http.Request, apiKey string, keyName string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+    account := credential.Account
+
+    if !checkRequestRate(w, req, account) {
+        return
+    }
+
+    if !authorize(w, req, credential, OpKeys, keyName) {
+        return
+    }
+
+    args := req.URL.Query()
+
+    switch {
+        case keyName == "" && req.Method == "GET":
+            keyInfos, err := ListApiKeys(account)
+            if err != nil {
+                reportError(w, req, 500, err.Error())
+
+                return
+            }
+
+            WriteJSON(w, req, keyInfos)
+        case keyName == "" && args.Has("create"):
+            if req.Method != "POST" {
+                reportError(w, req, 400, "use POST for create operation")
+
+                return
+            }
+
+            var expiresIn time.Duration
+            if args.Has("expiresIn") {
+                var err error
+                if expiresIn, err = time.ParseDuration(args.Get("expiresIn")); err != nil || expiresIn <= 0 {
+                    reportError(w, req, 400, fmt.Sprintf("invalid expiresIn '%s'", args.Get("expiresIn")))
+
+                    return
+                }
+            }
+
+            scope, err := NewKeyScope(args.Get("scope"), args.Get("operations"), expiresIn)
+            if err != nil {
+                reportError(w, req, 400, err.Error())
+
+                return
+            }
+
+            apiKey, err := CreateApiKey(account, args.Get("name"), scope)
+            recordRequestAudit(req, account, account, AuditKeyCreate, args.Get("name"), 0, err)
+            if err != nil {
+                reportError(w, req, 400, err.Error())
+
+                return
+            }
+
+            WriteJSON(w, req, apiKey)
+        case keyName != "" && args.Has("rotate"):
+            if req.Method != "POST" {
+                reportError(w, req, 400, "use POST for rotate operation")
+
+                return
+            }
+
+            apiKey, err := RotateApiKey(account, keyName)
+            recordRequestAudit(req, account, account, AuditKeyRotate, keyName, 0, err)
+            if err != nil {
+                reportKeyError(w, req, err)
+
+                return
+            }
+
+            WriteJSON(w, req, apiKey)
+        case keyName != "" && args.Has("revoke"):
+            if req.Method != "POST" {
+                reportError(w, req, 400, "use POST for revoke operation")
+
+                return
+            }
+
+            err := RevokeApiKey(account, keyName)
+            recordRequestAudit(req, account, account, AuditKeyRevoke, keyName, 0, err)
+            if err != nil {
+                reportKeyError(w, req, err)
+
+                return
+            }
+
+            success := &HttpSuccess{
+                StatusCode: 200,
+            }
+
+            w.WriteHeader(200)
+            WriteJSON(w, req, success)
+        default:
+            reportError(w, req, 400, "bad request")
+    }
+}
+
+func reportKeyError(w http.ResponseWriter, req *http.Request, err error) {
+    if errors.Is(err, ErrKeyNotFound) {
+        reportError(w, req, 404, err.Error())
+    } else {
+        reportError(w, req, 400, err.Error())
+    }
+}
+
+func apiNamespacesHandler(w http.ResponseWriter, req *http.Request, apiKey string, namespaceName string) {
+    credential, ok := verifyClient(w, req, apiKey)
+    if !ok {
+        return
+    }
+    account := credential.Account
+
+    if !checkRequestRate(w, req, account) {
+        return
+    }
+
+    if !authorize(w, req, credential, OpNamespaces, namespaceName) {
+        return
+    }
+
+    args := req.URL.Query()
+
+    if namespaceName == "" {
+        if req.Method != "GET" {
+            reportError(w, req, 400, "bad request")
+
+            return
+        }
+
+        WriteJSON(w, req, ListNamespaces(account))
+
+        return
+    }
+
+    if req.Method != "POST" {
+        reportError(w, req, 400, "use POST to manage namespaces")
+
+        return
+    }
+
+    // an empty email would match every grant, and any client
+    if (args.Has("grant") || args.Has("revoke")) && args.Get("email") == "" {
+        reportError(w, req, 400, "email required")
+
+        return
+    }
+
+    var err error
+    switch {
+        case args.Has("create"):
+            _, err = CreateNamespace(account, namespaceName)
+        case args.Has("grant") && args.Has("email"):
+            err = GrantNamespace(account, namespaceName, args.Get("email"))
+        case args.Has("revoke") && args.Has("email"):
+            err = RevokeNamespace(account, namespaceName, args.Get("email"))
+        default:
+            reportError(w, req, 400, "bad request")
+
+            return
+    }
+
+    if err != nil {
+        reportNamespaceError(w, req, err)
+
+        return
+    }
+
+    success := &HttpSuccess{
+        StatusCode: 200,
+    }
+
+    w.WriteHeader(200)
+    WriteJSON(w, req, success)
+}
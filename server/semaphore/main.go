@@ -5,6 +5,11 @@ import (
 	"errors"
 )
 
+var (
+	ErrTimeout      = errors.New("lock failed: wait timeout expired")
+	ErrDisconnected = errors.New("lock failed: client disconnected")
+)
+
 type Semaphore struct {
 	resource chan bool
 }
@@ -42,12 +47,10 @@ func (s *Semaphore) Lock(timeout time.Duration, done <-chan struct{}) error {
 			return errors.New("lock failed: unable to acquire lock")
 		}
 	case <-done:
-		return errors.New("lock failed: client disconnected")
+		return ErrDisconnected
 	case _ = <-timeoutChannel:
-		return errors.New("lock failed: wait timeout expired")
+		return ErrTimeout
 	}
-
-	return errors.New("lock failed: unknown error")
 }
 
 func (s *Semaphore) Unlock() bool {
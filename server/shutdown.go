@@ -0,0 +1,236 @@
+// Graceful shutdown: draining lock requests, saving held locks so that
+// they survive a restart, and stopping the servers.
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/google/uuid"
+    "mutex/server/persist"
+    "mutex/server/semaphore"
+)
+
+// A lock held when the server shut down, restored when it starts again.
+type HeldLock struct {
+    ID string `db-pk:"true"`
+    Resources string
+    Identifier string
+    Token int64
+    RequestID string
+    // unix times in milliseconds; LeaseExpires is zero for no lease
+    Acquired int64
+    LeaseExpires int64
+}
+
+var ErrDraining = errors.New("server is shutting down")
+
+// How long clients are asked to wait before retrying requests refused
+// while draining.
+const drainRetryAfter = "5"
+
+var draining int32
+var drainChannel = make(chan struct{})
+var drainOnce sync.Once
+
+func Draining() bool {
+    return atomic.LoadInt32(&draining) == 1
+}
+
+// Stop accepting lock requests and fail those waiting with ErrDraining.
+func StartDrain() {
+    drainOnce.Do(func () {
+        atomic.StoreInt32(&draining, 1)
+        close(drainChannel)
+    })
+}
+
+// Return a channel closed when ctx is done or the server starts draining,
+// and a function to call once the channel is no longer needed.
+func waitDone(ctx context.Context) (<-chan struct{}, func ()) {
+    done := make(chan struct{})
+    stop := make(chan struct{})
+    drain := drainChannel
+
+    go func () {
+        select {
+        case <-ctx.Done():
+            close(done)
+        case <-drain:
+            close(done)
+        case <-stop:
+        }
+    }()
+
+    return done, func () { close(stop) }
+}
+
+// Convert the error of a wait interrupted by draining to ErrDraining.
+func drainError(ctx context.Context, err error) error {
+    if errors.Is(err, semaphore.ErrDisconnected) && ctx.Err() == nil && Draining() {
+        return ErrDraining
+    }
+
+    return err
+}
+
+// The locks held now.
+func currentHeldLocks() []*HeldLock {
+    heldLocks := []*HeldLock{}
+
+    crmMutex.RLock()
+    for resources, cr := range clientResourceMap {
+        cr.mu.RLock()
+        for identifier, state := range cr.semaphoreMap {
+            if state.holder == 0 {
+                continue
+            }
+
+            heldLock := &HeldLock{
+                ID: uuid.New().String(),
+                Resources: resources,
+                Identifier: identifier,
+                Token: int64(state.holder),
+                RequestID: state.holderRequestID,
+                Acquired: state.acquired.UnixMilli(),
+            }
+            if !state.leaseExpires.IsZero() {
+                heldLock.LeaseExpires = state.leaseExpires.UnixMilli()
+            }
+
+            heldLocks = append(heldLocks, heldLock)
+        }
+        cr.mu.RUnlock()
+    }
+    crmMutex.RUnlock()
+
+    return heldLocks
+}
+
+// Record every held lock in the database.
+func SaveHeldLocks() (int, error) {
+    heldLocks := currentHeldLocks()
+    for _, heldLock := range heldLocks {
+        if err := persist.Insert(heldLock); err != nil {
+            return 0, err
+        }
+    }
+
+    return len(heldLocks), nil
+}
+
+// Reacquire the locks saved by SaveHeldLocks, with their original tokens,
+// except for those whose leases have since expired.
+func RestoreHeldLocks() (int, error) {
+    heldLocks := []HeldLock{}
+    if err := persist.FindAll(&HeldLock{}, &heldLocks); err != nil {
+        return 0, err
+    }
+
+    restored := 0
+    now := time.Now()
+    for _, heldLock := range heldLocks {
+        var lease time.Duration
+        if heldLock.LeaseExpires != 0 {
+            if lease = time.UnixMilli(heldLock.LeaseExpires).Sub(now); lease <= 0 {
+                RecordAudit(&AuditEvent{
+                    Resources: heldLock.Resources,
+                    Action: AuditExpire,
+                    Identifier: heldLock.Identifier,
+                    Holder: heldLock.Token,
+                    RequestID: heldLock.RequestID,
+                })
+
+                continue
+            }
+        }
+
+        if err := restoreLock(&heldLock, lease); err != nil {
+            logger.Warn("unable to restore held lock", "error", err, "mutex", heldLock.Identifier)
+
+            continue
+        }
+        restored++
+    }
+
+    for _, heldLock := range heldLocks {
+        if err := persist.Delete(&heldLock); err != nil {
+            return restored, err
+        }
+    }
+
+    return restored, nil
+}
+
+func restoreLock(heldLock *HeldLock, lease time.Duration) error {
+    cr := lockClientResources(heldLock.Resources)
+    defer cr.mu.Unlock()
+
+    state, ok := cr.semaphoreMap[heldLock.Identifier]
+    if !ok {
+        state = &mutexState{
+            semaphore: semaphore.NewSemaphore(1),
+            stats: cr.stats(heldLock.Identifier),
+        }
+        cr.semaphoreMap[heldLock.Identifier] = state
+    }
+
+    if err := state.semaphore.Lock(0, nil); err != nil {
+        return err
+    }
+
+    token := uint64(heldLock.Token)
+    if token > cr.lockGeneration {
+        cr.lockGeneration = token
+    }
+
+    state.holder = token
+    state.holderRequestID = heldLock.RequestID
+    state.acquired = time.UnixMilli(heldLock.Acquired)
+    state.lastUsed = time.Now()
+    cr.heldMutexes++
+
+    if lease > 0 {
+        cr.startLease(heldLock.Resources, heldLock.Identifier, state, lease,
+                logger.With("request_id", heldLock.RequestID, "mutex", heldLock.Identifier))
+    }
+
+    return nil
+}
+
+// Drain, then stop the servers, waiting up to timeout for requests in
+// progress to finish, and save held locks.
+func Shutdown(servers []*http.Server, timeout time.Duration) {
+    logger.Info("draining", "timeout", timeout)
+    StartDrain()
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    var wg sync.WaitGroup
+    for _, server := range servers {
+        wg.Add(1)
+        go func (server *http.Server) {
+            defer wg.Done()
+
+            if err := server.Shutdown(ctx); err != nil {
+                logger.Warn("server shutdown incomplete", "addr", server.Addr, "error", err)
+            }
+        }(server)
+    }
+    wg.Wait()
+
+    if saved, err := SaveHeldLocks(); err != nil {
+        logger.Error("unable to save held locks", "error", err)
+    } else {
+        logger.Info("saved held locks", "count", saved)
+    }
+
+    if err := tracer.Flush(); err != nil {
+        logger.Warn("unable to export traces", "error", err)
+    }
+}
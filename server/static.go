@@ -0,0 +1,52 @@
+// Static files, including the dashboard. Files are served from the -dir
+// directory if it exists, otherwise from the copy embedded in the binary.
+package main
+
+import (
+    "embed"
+    "io/fs"
+    "net/http"
+    "os"
+    "path"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// Hides directories without an index.html unless -generateIndexPages is
+// set, so that http.FileServer doesn't list them.
+type indexFS struct {
+    http.FileSystem
+}
+
+func (f indexFS) Open(name string) (http.File, error) {
+    file, err := f.FileSystem.Open(name)
+    if err != nil {
+        return nil, err
+    }
+
+    if info, err := file.Stat(); err == nil && info.IsDir() && !*GenerateIndexPages {
+        index, err := f.FileSystem.Open(path.Join(name, "index.html"))
+        if err != nil {
+            file.Close()
+
+            return nil, os.ErrNotExist
+        }
+        index.Close()
+    }
+
+    return file, nil
+}
+
+func newStaticHandler() http.Handler {
+    var files http.FileSystem
+
+    if info, err := os.Stat(*Dir); err == nil && info.IsDir() {
+        files = http.Dir(*Dir)
+    } else {
+        embedded, _ := fs.Sub(embeddedStatic, "static")
+        files = http.FS(embedded)
+    }
+
+    return http.FileServer(indexFS{files})
+}
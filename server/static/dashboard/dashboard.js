@@ -0,0 +1,161 @@
+// Polls the dashboard API and renders live lock state. The credential is
+// kept in sessionStorage and sent in an Authorization header.
+(function () {
+  "use strict";
+
+  var refreshMs = 2000;
+  var timer = null;
+
+  function $(id) {
+    return document.getElementById(id);
+  }
+
+  function session() {
+    return {
+      credential: sessionStorage.getItem("credential"),
+      namespace: sessionStorage.getItem("namespace") || "",
+      admin: sessionStorage.getItem("admin") === "true"
+    };
+  }
+
+  function dashboardURL(s) {
+    if (s.admin) {
+      return "/api/admin/dashboard";
+    }
+
+    var url = "/api/dashboard";
+    if (s.namespace) {
+      url += "?namespace=" + encodeURIComponent(s.namespace);
+    }
+
+    return url;
+  }
+
+  function duration(sinceMs) {
+    if (!sinceMs) {
+      return "";
+    }
+
+    var seconds = Math.max(0, Math.round((Date.now() - sinceMs) / 1000));
+    if (seconds < 60) {
+      return seconds + "s";
+    }
+    if (seconds < 3600) {
+      return Math.floor(seconds / 60) + "m " + (seconds % 60) + "s";
+    }
+
+    return Math.floor(seconds / 3600) + "h " + Math.floor((seconds % 3600) / 60) + "m";
+  }
+
+  function cell(row, text, className) {
+    var td = document.createElement("td");
+    td.textContent = text === undefined || text === null ? "" : String(text);
+    if (className) {
+      td.className = className;
+    }
+    row.appendChild(td);
+
+    return td;
+  }
+
+  function fill(tableId, items, columns) {
+    var tbody = $(tableId).querySelector("tbody");
+    tbody.textContent = "";
+
+    if (items.length === 0) {
+      var row = tbody.insertRow();
+      var td = cell(row, "none", "empty");
+      td.colSpan = $(tableId).querySelectorAll("th").length;
+
+      return;
+    }
+
+    items.forEach(function (item) {
+      var row = tbody.insertRow();
+      columns.forEach(function (column) {
+        column(row, item);
+      });
+    });
+  }
+
+  function render(state) {
+    fill("hotSpots", state.hotSpots, [
+      function (row, m) { cell(row, m.resources, "resources"); },
+      function (row, m) { cell(row, m.identifier); },
+      function (row, m) { cell(row, m.waiters); },
+      function (row, m) { cell(row, duration(m.acquired)); }
+    ]);
+
+    fill("mutexes", state.mutexes, [
+      function (row, m) { cell(row, m.resources, "resources"); },
+      function (row, m) { cell(row, m.identifier); },
+      function (row, m) { cell(row, m.locked ? "locked" : "free", m.locked ? "locked" : ""); },
+      function (row, m) { cell(row, m.token); },
+      function (row, m) { cell(row, duration(m.acquired)); },
+      function (row, m) { cell(row, m.waiters); }
+    ]);
+
+    fill("events", state.events, [
+      function (row, e) { cell(row, new Date(e.time).toLocaleTimeString()); },
+      function (row, e) { cell(row, e.client || "server"); },
+      function (row, e) { cell(row, e.action); },
+      function (row, e) { cell(row, e.identifier); },
+      function (row, e) { cell(row, e.holder); },
+      function (row, e) { cell(row, e.outcome, e.outcome === "ok" ? "" : "failed"); }
+    ]);
+  }
+
+  function refresh() {
+    var s = session();
+
+    fetch(dashboardURL(s), {
+      headers: { "Authorization": "Bearer " + s.credential }
+    }).then(function (res) {
+      return res.json().then(function (body) {
+        if (!res.ok) {
+          throw new Error(body.errorMessage || res.statusText);
+        }
+
+        return body;
+      });
+    }).then(function (state) {
+      render(state);
+      $("status").textContent = "updated " + new Date().toLocaleTimeString();
+    }).catch(function (err) {
+      $("status").textContent = "error: " + err.message;
+    });
+  }
+
+  function show() {
+    var loggedIn = !!session().credential;
+
+    $("login").hidden = loggedIn;
+    $("dashboard").hidden = !loggedIn;
+    $("logout").hidden = !loggedIn;
+    document.body.classList.toggle("admin", session().admin);
+
+    clearInterval(timer);
+    if (loggedIn) {
+      refresh();
+      timer = setInterval(refresh, refreshMs);
+    } else {
+      $("status").textContent = "";
+    }
+  }
+
+  $("login").addEventListener("submit", function (event) {
+    event.preventDefault();
+    sessionStorage.setItem("credential", $("credential").value.trim());
+    sessionStorage.setItem("namespace", $("namespace").value.trim());
+    sessionStorage.setItem("admin", $("admin").checked ? "true" : "false");
+    $("credential").value = "";
+    show();
+  });
+
+  $("logout").addEventListener("click", function () {
+    sessionStorage.clear();
+    show();
+  });
+
+  show();
+})();
@@ -0,0 +1,68 @@
+// OpenTelemetry tracing of HTTP requests and the mutex operations they
+// perform.
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "mutex/server/tracing"
+)
+
+// nil (tracing disabled) unless -otlpEndpoint is set
+var tracer *tracing.Tracer
+
+func newTracer() *tracing.Tracer {
+    if *OTLPEndpoint == "" {
+        return nil
+    }
+
+    exporter := tracing.NewExporter(*OTLPEndpoint, 512, 5 * time.Second)
+    exporter.SetErrorHandler(func (err error) {
+        logger.Warn("trace export failed", "error", err)
+    })
+
+    return tracing.NewTracer("mutex", exporter)
+}
+
+// Trace every request, continuing the caller's trace if the request carries
+// a W3C traceparent header.
+func traceHandler(next http.Handler) http.Handler {
+    return http.HandlerFunc(func (w http.ResponseWriter, req *http.Request) {
+        if tracer == nil {
+            next.ServeHTTP(w, req)
+
+            return
+        }
+
+        ctx := req.Context()
+        if parent, ok := tracing.ParseTraceparent(req.Header.Get("traceparent")); ok {
+            ctx = tracing.ContextWithRemoteParent(ctx, parent)
+        }
+
+        route := routeLabel(req.URL.Path)
+        ctx, span := tracer.Start(ctx, req.Method + " " + route, tracing.KindServer)
+        defer span.End()
+
+        recorder := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(recorder, req.WithContext(ctx))
+
+        if recorder.statusCode == 0 {
+            recorder.statusCode = 200
+        }
+
+        span.SetAttribute("http.method", req.Method)
+        span.SetAttribute("http.route", route)
+        span.SetAttribute("http.status_code", recorder.statusCode)
+        if recorder.statusCode >= 500 {
+            span.SetError(errorStatus(recorder.statusCode))
+        }
+    })
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string {
+    return "HTTP status " + strconv.Itoa(int(e))
+}
@@ -0,0 +1,487 @@
+// Package tracing records spans and exports them to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding. Incoming W3C
+// traceparent headers are honored so that spans join the caller's trace.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so tracing can be
+// disabled without guarding every call site.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Format the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Parse a W3C traceparent header value.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+type SpanKind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+)
+
+// A Span records a timed operation. Spans are exported when they end.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	context    SpanContext
+	parent     SpanID
+	name       string
+	kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attributes []attribute
+	err        string
+	ended      bool
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.context
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attribute{key, value})
+}
+
+// Mark the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// End the span and queue it for export. Only the first call has any
+// effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Return a context carrying span as the parent of spans started from it.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+
+	return span
+}
+
+// Return a context carrying a span context received from another service,
+// typically parsed from a traceparent header, as the parent of spans
+// started from it.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// A Tracer starts spans and exports them when they end.
+type Tracer struct {
+	serviceName string
+	exporter    *Exporter
+}
+
+func NewTracer(serviceName string, exporter *Exporter) *Tracer {
+	return &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+	}
+}
+
+// Start a span as a child of the span (or remote parent) in ctx, or as the
+// root of a new trace if there isn't one. Returns a context carrying the
+// new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parent = parent.context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.IsValid() {
+		span.context.TraceID = remote.TraceID
+		span.context.Sampled = remote.Sampled
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// Export any spans that have ended but not been exported yet.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exporter.Flush()
+}
+
+// An Exporter batches ended spans and posts them to an OTLP/HTTP
+// collector's /v1/traces endpoint. At most maxPendingBatches batches of
+// spans wait to be exported; spans ending while the queue is full are
+// dropped and counted.
+type Exporter struct {
+	endpoint  string
+	client    *http.Client
+	batchSize int
+
+	mu       sync.Mutex
+	pending  []*Span
+	dropped  uint64
+	reported uint64
+	onError  func(error)
+	flush    chan struct{}
+}
+
+const maxPendingBatches = 8
+
+// Create an exporter posting to the collector at endpoint (e.g.
+// "http://localhost:4318"), exporting whenever batchSize spans are pending
+// and at least every interval.
+func NewExporter(endpoint string, batchSize int, interval time.Duration) *Exporter {
+	e := &Exporter{
+		endpoint:  strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:    &http.Client{Timeout: 10 * time.Second},
+		batchSize: batchSize,
+		flush:     make(chan struct{}, 1),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.flush:
+			}
+			e.report(e.Flush())
+		}
+	}()
+
+	return e
+}
+
+// Set a function to be called with the errors of background exports, and
+// when spans have been dropped since it was last called.
+func (e *Exporter) SetErrorHandler(onError func(error)) {
+	e.mu.Lock()
+	e.onError = onError
+	e.mu.Unlock()
+}
+
+// The number of spans dropped because too many were waiting for export.
+func (e *Exporter) Dropped() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.dropped
+}
+
+func (e *Exporter) report(err error) {
+	e.mu.Lock()
+	onError := e.onError
+	dropped := e.dropped - e.reported
+	e.reported = e.dropped
+	e.mu.Unlock()
+
+	if onError == nil {
+		return
+	}
+
+	if err != nil {
+		onError(err)
+	}
+	if dropped > 0 {
+		onError(errors.New(fmt.Sprintf("dropped %d spans: export queue full", dropped)))
+	}
+}
+
+func (e *Exporter) enqueue(span *Span) {
+	e.mu.Lock()
+	if len(e.pending) >= maxPendingBatches*e.batchSize {
+		e.dropped++
+		e.mu.Unlock()
+
+		return
+	}
+	e.pending = append(e.pending, span)
+	full := len(e.pending) >= e.batchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Export all pending spans. Spans that fail to export are dropped.
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("trace export failed: collector returned %d", res.StatusCode))
+	}
+
+	return nil
+}
+
+// OTLP JSON encoding (see opentelemetry-proto's trace.proto). IDs are hex
+// strings and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const otlpStatusError = 2
+
+func encodeValue(value interface{}) otlpValue {
+	switch v := value.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func encodeSpans(spans []*Span) *otlpRequest {
+	request := &otlpRequest{}
+	byService := map[string]int{}
+
+	for _, span := range spans {
+		service := span.tracer.serviceName
+		i, ok := byService[service]
+		if !ok {
+			i = len(request.ResourceSpans)
+			byService[service] = i
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{{"service.name", encodeValue(service)}},
+				},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "mutex/server/tracing"}}},
+			})
+		}
+
+		span.mu.Lock()
+		encoded := otlpSpan{
+			TraceID:           span.context.TraceID.String(),
+			SpanID:            span.context.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parent != (SpanID{}) {
+			encoded.ParentSpanID = span.parent.String()
+		}
+		for _, attr := range span.attributes {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute{attr.key, encodeValue(attr.value)})
+		}
+		if span.err != "" {
+			encoded.Status = otlpStatus{Code: otlpStatusError, Message: span.err}
+		}
+		span.mu.Unlock()
+
+		scopeSpans := &request.ResourceSpans[i].ScopeSpans[0]
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+
+	return request
+}
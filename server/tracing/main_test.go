@@ -0,0 +1,190 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in for an OpenTelemetry collector that records the spans posted
+// to it.
+type collector struct {
+	mu    sync.Mutex
+	spans []map[string]interface{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(404)
+		return
+	}
+
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+}
+
+func (c *collector) find(name string) map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, span := range c.spans {
+		if span["name"] == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := ParseTraceparent(header)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", header, sc, ok)
+	}
+
+	if sc.Traceparent() != header {
+		t.Errorf("Traceparent() = %q, expected %q", sc.Traceparent(), header)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("ParseTraceparent(%q): expected failure", invalid)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	tracer := NewTracer("test", NewExporter(server.URL, 100, time.Hour))
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteParent(context.Background(), remote)
+
+	ctx, parent := tracer.Start(ctx, "parent", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.SetAttribute("mutex.id", "m1")
+	child.SetAttribute("wait.ms", 12)
+	child.SetError(errors.New("wait timeout expired"))
+	child.End()
+	parent.End()
+
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	parentSpan, childSpan := c.find("parent"), c.find("child")
+	if parentSpan == nil || childSpan == nil {
+		t.Fatalf("collector did not receive spans: %v", c.spans)
+	}
+
+	if parentSpan["traceId"] != remote.TraceID.String() || parentSpan["parentSpanId"] != remote.SpanID.String() {
+		t.Errorf("parent span did not join the remote trace: %v", parentSpan)
+	}
+
+	if childSpan["traceId"] != remote.TraceID.String() || childSpan["parentSpanId"] != parentSpan["spanId"] {
+		t.Errorf("child span is not a child of parent: %v", childSpan)
+	}
+
+	status, _ := childSpan["status"].(map[string]interface{})
+	if status["code"] != float64(otlpStatusError) {
+		t.Errorf("child span status: expected error: %v", childSpan["status"])
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop", KindInternal)
+	span.SetAttribute("key", "value")
+	span.End()
+
+	if SpanFromContext(ctx) != nil || tracer.Flush() != nil {
+		t.Errorf("nil tracer recorded a span")
+	}
+}
+
+func TestExportQueueFull(t *testing.T) {
+	posted := make(chan bool, 10)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		posted <- true
+		<-release
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	exporter := NewExporter(server.URL, 1, time.Hour)
+	errs := make(chan error, 10)
+	exporter.SetErrorHandler(func(err error) {
+		errs <- err
+	})
+	tracer := NewTracer("test", exporter)
+
+	// the first span's export blocks, so the queue fills behind it
+	_, span := tracer.Start(context.Background(), "first", KindInternal)
+	span.End()
+	<-posted
+
+	for i := 0; i < 20; i++ {
+		_, span := tracer.Start(context.Background(), "queued", KindInternal)
+		span.End()
+	}
+
+	if dropped := exporter.Dropped(); dropped != 20-maxPendingBatches {
+		t.Errorf("Dropped: expected %d spans: %d", 20-maxPendingBatches, dropped)
+	}
+
+	release <- true
+
+	reported := ""
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			reported += err.Error() + "\n"
+		case <-time.After(5 * time.Second):
+			t.Fatalf("export errors not reported: %q", reported)
+		}
+	}
+
+	if !strings.Contains(reported, "collector returned 500") ||
+		!strings.Contains(reported, fmt.Sprintf("dropped %d spans", 20-maxPendingBatches)) {
+		t.Errorf("reported errors: %q", reported)
+	}
+}